@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported values for Plugin.Archive.
+const (
+	archiveTarGzip = "tar.gz"
+	archiveTarZstd = "tar.zst"
+	archiveZip     = "zip"
+)
+
+var archiveContentTypes = map[string]string{
+	archiveTarGzip: "application/gzip",
+	archiveTarZstd: "application/zstd",
+	archiveZip:     "application/zip",
+}
+
+func validateArchive(format string) error {
+	if format == "" || archiveContentTypes[format] != "" {
+		return nil
+	}
+	return fmt.Errorf("unsupported archive format '%s', expected '%s', '%s' or '%s'", format, archiveTarGzip, archiveTarZstd, archiveZip)
+}
+
+// validateArchiveOptions checks the archive format and rejects the options
+// archive mode cannot honour. The archive object gets its content type from the
+// format, so per-file headers and rules would be silently dropped.
+func (p *Plugin) validateArchiveOptions() error {
+	if err := validateArchive(p.Archive); err != nil {
+		return err
+	}
+	if p.Archive == "" {
+		return nil
+	}
+	if p.Target == "" || strings.HasSuffix(p.Target, "/") {
+		return fmt.Errorf("target must name the archive object, got '%s'", p.Target)
+	}
+	if p.Sync || p.Delete || p.Compression != "" || p.cse != nil {
+		return fmt.Errorf("archive cannot be combined with sync, delete, compression or client-side encryption")
+	}
+	if p.RulesFile != "" || len(p.ContentType) > 0 || len(p.ContentEncoding) > 0 {
+		return fmt.Errorf("archive cannot be combined with rules_file, content_type or content_encoding")
+	}
+	return nil
+}
+
+// archiveEntry is a local file and its name inside the archive.
+type archiveEntry struct {
+	path string
+	name string
+}
+
+// writeArchive writes the entries to w in the given format, keeping the file
+// modes and modification times.
+func writeArchive(w io.Writer, format string, entries []archiveEntry) error {
+	if format == archiveZip {
+		return writeZip(w, entries)
+	}
+
+	var cw io.WriteCloser
+	if format == archiveTarZstd {
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		cw = zw
+	} else {
+		cw = gzip.NewWriter(w)
+	}
+
+	tw := tar.NewWriter(cw)
+	for _, entry := range entries {
+		if err := addTarEntry(tw, entry); err != nil {
+			return fmt.Errorf("archive %s: %w", entry.path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+func addTarEntry(tw *tar.Writer, entry archiveEntry) error {
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = entry.name
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		if err := addZipEntry(zw, entry); err != nil {
+			return fmt.Errorf("archive %s: %w", entry.path, err)
+		}
+	}
+	return zw.Close()
+}
+
+func addZipEntry(zw *zip.Writer, entry archiveEntry) error {
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return err
+	}
+	hdr.Name = entry.name
+	hdr.Method = zip.Deflate
+
+	fw, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// archiveEntries resolves the archive names of the matched files the same way
+// their object keys are resolved, relative to the archive instead of Target.
+func (p *Plugin) archiveEntries(matches []string, normalizedStrip string, compiled *regexp.Regexp) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	names := map[string]string{}
+	for _, match := range matches {
+		if err := isDir(match, matches); err != nil {
+			if err == errSkip {
+				continue
+			}
+			slog.Error("Directory specified without glob pattern", "error", err, "match", match)
+			return nil, err
+		}
+
+		name, _, _ := p.keyBelow("", match, normalizedStrip, compiled)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("files '%s' and '%s' both resolve to archive entry '%s'", other, match, name)
+		}
+		names[name] = match
+		entries = append(entries, archiveEntry{path: match, name: name})
+	}
+	return entries, nil
+}
+
+// uploadArchive streams the matched files into a single archive object at
+// Target, without writing the archive to disk.
+func (p *Plugin) uploadArchive(ctx context.Context, uploader *manager.Uploader, matches []string, normalizedStrip string, compiled *regexp.Regexp, patterns *filePatterns) error {
+	entries, err := p.archiveEntries(matches, normalizedStrip, compiled)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		slog.Warn("No files to archive", "source", p.Source)
+		return nil
+	}
+
+	if p.DryRun {
+		for _, entry := range entries {
+			slog.Info("Dry-run: would archive", "name", entry.path, "entry", entry.name)
+		}
+		slog.Info("Dry-run: would upload archive", "bucket", p.Bucket, "target", p.Target, "format", p.Archive, "files", len(entries))
+		return nil
+	}
+
+	tagging, err := encodeTags(patterns.tags.match(p.Target))
+	if err != nil {
+		return fmt.Errorf("tags for '%s': %w", p.Target, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, p.Archive, entries))
+	}()
+	defer pr.Close()
+
+	input := &s3.PutObjectInput{
+		Body:        pr,
+		Bucket:      aws.String(p.Bucket),
+		Key:         aws.String(p.Target),
+		ContentType: aws.String(archiveContentTypes[p.Archive]),
+	}
+	if metadata := patterns.metadata.match(p.Target); len(metadata) > 0 {
+		input.Metadata = metadata
+	}
+	if tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	if cacheControl := patterns.cacheControls.match(p.Target); cacheControl != "" {
+		input.CacheControl = aws.String(cacheControl)
+	}
+
+	p.applyEncryption(input, p.Encryption, p.KMSKeyID)
+
+	if p.StorageClass != "" {
+		input.StorageClass = s3types.StorageClass(p.StorageClass)
+	}
+
+	if p.Access != "" {
+		input.ACL = s3types.ObjectCannedACL(p.Access)
+	}
+
+	if p.Checksum != "" {
+		applyChecksum(input, p.Checksum, "", true)
+	}
+
+	slog.Info("Uploading archive", "bucket", p.Bucket, "target", p.Target, "format", p.Archive, "files", len(entries))
+	if _, err := uploader.Upload(ctx, input); err != nil {
+		slog.Error("Could not upload archive", "bucket", p.Bucket, "target", p.Target, "error", err)
+		return fmt.Errorf("upload archive %s: %w", p.Target, err)
+	}
+
+	slog.Info("Uploaded archive", "bucket", p.Bucket, "target", p.Target, "files", len(entries))
+	return nil
+}
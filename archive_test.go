@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestValidateArchive(t *testing.T) {
+	for _, format := range []string{"", archiveTarGzip, archiveTarZstd, archiveZip} {
+		if err := validateArchive(format); err != nil {
+			t.Errorf("%s: unexpected error: %v", format, err)
+		}
+	}
+	if err := validateArchive("rar"); err == nil {
+		t.Error("expected error for unsupported archive format")
+	}
+}
+
+func TestValidateArchiveOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		expectError bool
+	}{
+		{name: "no archive", plugin: Plugin{Sync: true, RulesFile: "rules.yml"}},
+		{name: "archive", plugin: Plugin{Archive: archiveTarGzip, Target: "cache/deps.tar.gz", CacheControl: map[string]string{".*": "no-cache"}}},
+		{name: "unsupported format", plugin: Plugin{Archive: "rar", Target: "cache/deps.rar"}, expectError: true},
+		{name: "target prefix", plugin: Plugin{Archive: archiveZip, Target: "cache/"}, expectError: true},
+		{name: "sync", plugin: Plugin{Archive: archiveZip, Target: "site.zip", Sync: true}, expectError: true},
+		{name: "compression", plugin: Plugin{Archive: archiveZip, Target: "site.zip", Compression: "gzip"}, expectError: true},
+		{name: "rules file", plugin: Plugin{Archive: archiveZip, Target: "site.zip", RulesFile: "rules.yml"}, expectError: true},
+		{name: "content type", plugin: Plugin{Archive: archiveZip, Target: "site.zip", ContentType: map[string]string{".*": "text/html"}}, expectError: true},
+		{name: "content encoding", plugin: Plugin{Archive: archiveTarGzip, Target: "site.tar.gz", ContentEncoding: map[string]string{".*": "gzip"}}, expectError: true},
+	}
+
+	for _, tc := range tests {
+		err := tc.plugin.validateArchiveOptions()
+		if tc.expectError && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+type archivedFile struct {
+	content string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func readArchive(t *testing.T, format string, data []byte) map[string]archivedFile {
+	t.Helper()
+	files := map[string]archivedFile{}
+
+	if format == archiveZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name] = archivedFile{string(content), f.Mode(), f.Modified}
+		}
+		return files
+	}
+
+	var r io.Reader
+	var err error
+	if format == archiveTarZstd {
+		r, err = zstd.NewReader(bytes.NewReader(data))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = archivedFile{string(content), hdr.FileInfo().Mode(), hdr.ModTime}
+	}
+	return files
+}
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"index.html":    "<html></html>",
+		"assets/app.js": "console.log(1)",
+	}
+	var entries []archiveEntry
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, archiveEntry{path: path, name: name})
+	}
+
+	for _, format := range []string{archiveTarGzip, archiveTarZstd, archiveZip} {
+		var buf bytes.Buffer
+		if err := writeArchive(&buf, format, entries); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got := readArchive(t, format, buf.Bytes())
+		if len(got) != len(files) {
+			t.Errorf("%s: expected %d entries, got %d", format, len(files), len(got))
+		}
+		for name, content := range files {
+			f, ok := got[name]
+			if !ok {
+				t.Errorf("%s: missing entry %s", format, name)
+				continue
+			}
+			if f.content != content {
+				t.Errorf("%s %s: expected content %q, got %q", format, name, content, f.content)
+			}
+			if !f.modTime.Equal(modTime) {
+				t.Errorf("%s %s: expected mtime %v, got %v", format, name, modTime, f.modTime)
+			}
+			if f.mode.Perm() != 0o640 {
+				t.Errorf("%s %s: expected mode 0640, got %v", format, name, f.mode.Perm())
+			}
+		}
+	}
+}
+
+func TestWriteArchiveMissingFile(t *testing.T) {
+	entries := []archiveEntry{{path: filepath.Join(t.TempDir(), "missing"), name: "missing"}}
+	if err := writeArchive(io.Discard, archiveTarGzip, entries); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestArchiveEntries(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"dist/a.txt", "dist/sub/b.txt", "a.txt"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Plugin{StripPrefix: "dist/"}
+	entries, err := p.archiveEntries([]string{"dist/a.txt", "dist/sub/b.txt"}, "dist/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].name != "a.txt" || entries[1].name != "sub/b.txt" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	if _, err := p.archiveEntries([]string{"dist/a.txt", "a.txt"}, "dist/", nil); err == nil {
+		t.Error("expected error for duplicate archive entries")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Supported values for Plugin.Checksum.
+const (
+	checksumSHA256 = "sha256"
+	checksumCRC32C = "crc32c"
+)
+
+func validateChecksum(algorithm string) error {
+	switch algorithm {
+	case "", checksumSHA256, checksumCRC32C:
+		return nil
+	}
+	return fmt.Errorf("unsupported checksum algorithm '%s', expected '%s' or '%s'", algorithm, checksumSHA256, checksumCRC32C)
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	if algorithm == checksumCRC32C {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return sha256.New()
+}
+
+// encodeChecksum returns the digest in the base64 form S3 uses for checksums.
+func encodeChecksum(h hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// readerChecksum hashes the content of r and rewinds it for the upload.
+func readerChecksum(r io.ReadSeeker, algorithm string) (string, error) {
+	h := newChecksumHash(algorithm)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return encodeChecksum(h), nil
+}
+
+// applyChecksum sends the full object checksum with a single part upload.
+// Multipart uploads cannot carry it, so S3 verifies every part instead.
+func applyChecksum(input *s3.PutObjectInput, algorithm, sum string, multipart bool) {
+	if multipart {
+		if algorithm == checksumCRC32C {
+			input.ChecksumAlgorithm = s3types.ChecksumAlgorithmCrc32c
+		} else {
+			input.ChecksumAlgorithm = s3types.ChecksumAlgorithmSha256
+		}
+		return
+	}
+
+	if algorithm == checksumCRC32C {
+		input.ChecksumCRC32C = aws.String(sum)
+	} else {
+		input.ChecksumSHA256 = aws.String(sum)
+	}
+}
+
+// objectChecksum returns the full object checksum S3 reported for the
+// algorithm, or "" when there is none. Checksums of multipart objects are
+// composed from their parts and cannot be compared with the content.
+func objectChecksum(obj *s3.GetObjectOutput, algorithm string) string {
+	sum := aws.ToString(obj.ChecksumSHA256)
+	if algorithm == checksumCRC32C {
+		sum = aws.ToString(obj.ChecksumCRC32C)
+	}
+	if obj.ChecksumType == s3types.ChecksumTypeComposite || strings.Contains(sum, "-") {
+		return ""
+	}
+	return sum
+}
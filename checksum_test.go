@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestReaderChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{algorithm: checksumSHA256, expected: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek="},
+		{algorithm: checksumCRC32C, expected: "yZRlqg=="},
+	}
+
+	for _, tc := range tests {
+		r := strings.NewReader("hello world")
+		got, err := readerChecksum(r, tc.algorithm)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.algorithm, err)
+		}
+		if got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.algorithm, tc.expected, got)
+		}
+		if r.Len() != len("hello world") {
+			t.Errorf("%s: expected reader to be rewound", tc.algorithm)
+		}
+	}
+}
+
+func TestValidateChecksum(t *testing.T) {
+	for _, algorithm := range []string{"", checksumSHA256, checksumCRC32C} {
+		if err := validateChecksum(algorithm); err != nil {
+			t.Errorf("%q: unexpected error: %v", algorithm, err)
+		}
+	}
+	if err := validateChecksum("md5"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestObjectChecksum(t *testing.T) {
+	tests := []struct {
+		name      string
+		obj       *s3.GetObjectOutput
+		algorithm string
+		expected  string
+	}{
+		{
+			name:      "full object sha256",
+			obj:       &s3.GetObjectOutput{ChecksumSHA256: aws.String("abc="), ChecksumType: s3types.ChecksumTypeFullObject},
+			algorithm: checksumSHA256,
+			expected:  "abc=",
+		},
+		{
+			name:      "other algorithm",
+			obj:       &s3.GetObjectOutput{ChecksumSHA256: aws.String("abc=")},
+			algorithm: checksumCRC32C,
+			expected:  "",
+		},
+		{
+			name:      "composite",
+			obj:       &s3.GetObjectOutput{ChecksumCRC32C: aws.String("abc=-3"), ChecksumType: s3types.ChecksumTypeComposite},
+			algorithm: checksumCRC32C,
+			expected:  "",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := objectChecksum(tc.obj, tc.algorithm); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Supported values for Plugin.Compression, which are also the Content-Encoding
+// of the uploaded objects.
+const (
+	compressionGzip   = "gzip"
+	compressionBrotli = "br"
+)
+
+// compressedExtensions are formats that are compressed already and gain
+// nothing from another compression pass.
+var compressedExtensions = map[string]bool{
+	".7z":    true,
+	".avif":  true,
+	".br":    true,
+	".bz2":   true,
+	".gif":   true,
+	".gz":    true,
+	".heic":  true,
+	".jpeg":  true,
+	".jpg":   true,
+	".m4a":   true,
+	".mov":   true,
+	".mp3":   true,
+	".mp4":   true,
+	".ogg":   true,
+	".png":   true,
+	".rar":   true,
+	".tgz":   true,
+	".webm":  true,
+	".webp":  true,
+	".woff":  true,
+	".woff2": true,
+	".xz":    true,
+	".zip":   true,
+	".zst":   true,
+}
+
+func validateCompression(algorithm string) error {
+	switch algorithm {
+	case "", compressionGzip, compressionBrotli:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression '%s', expected '%s' or '%s'", algorithm, compressionGzip, compressionBrotli)
+}
+
+// compressFile returns the compression to use for the file at path, or "" to
+// upload it as is. Files that already carry a content encoding, are stored in
+// a compressed format or do not match one of the compress_include patterns
+// are left alone.
+func (p *Plugin) compressFile(path, contentEncoding string) string {
+	if p.Compression == "" || contentEncoding != "" {
+		return ""
+	}
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		return ""
+	}
+	if len(p.CompressInclude) > 0 && !matchesAny(p.CompressInclude, filepath.ToSlash(path)) {
+		return ""
+	}
+	return p.Compression
+}
+
+func newCompressor(w io.Writer, algorithm string) io.WriteCloser {
+	if algorithm == compressionBrotli {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	}
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+	return zw
+}
+
+// compressReader returns a reader streaming the compressed content of src, so
+// files are compressed while they are uploaded instead of in a temp file.
+// Closing the reader stops the compression.
+func compressReader(src io.Reader, algorithm string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := newCompressor(pw, algorithm)
+		_, err := io.Copy(zw, src)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
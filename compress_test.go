@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestValidateCompression(t *testing.T) {
+	for _, algorithm := range []string{"", compressionGzip, compressionBrotli} {
+		if err := validateCompression(algorithm); err != nil {
+			t.Errorf("%s: unexpected error: %v", algorithm, err)
+		}
+	}
+	if err := validateCompression("zstd"); err == nil {
+		t.Error("expected error for unsupported compression")
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	tests := []struct {
+		compression     string
+		include         []string
+		path            string
+		contentEncoding string
+		expected        string
+	}{
+		{"", nil, "dist/app.js", "", ""},
+		{compressionGzip, nil, "dist/app.js", "", compressionGzip},
+		{compressionBrotli, nil, "dist/index.html", "", compressionBrotli},
+		{compressionGzip, nil, "dist/app.js", "identity", ""},
+		{compressionGzip, nil, "dist/logo.PNG", "", ""},
+		{compressionGzip, nil, "dist/fonts/inter.woff2", "", ""},
+		{compressionGzip, nil, "dist/app.js.gz", "", ""},
+		{compressionGzip, []string{"**/*.js", "**/*.css"}, "dist/app.js", "", compressionGzip},
+		{compressionGzip, []string{"**/*.js", "**/*.css"}, "dist/index.html", "", ""},
+	}
+
+	for _, tc := range tests {
+		p := &Plugin{Compression: tc.compression, CompressInclude: tc.include}
+		if got := p.compressFile(tc.path, tc.contentEncoding); got != tc.expected {
+			t.Errorf("%s %s: expected '%s', got '%s'", tc.compression, tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestCompressReader(t *testing.T) {
+	content := strings.Repeat("<p>hello world</p>\n", 10000)
+
+	for _, algorithm := range []string{compressionGzip, compressionBrotli} {
+		r := compressReader(strings.NewReader(content), algorithm)
+		compressed, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if len(compressed) >= len(content) {
+			t.Errorf("%s: expected compressed content to be smaller, got %d bytes", algorithm, len(compressed))
+		}
+
+		var dr io.Reader
+		if algorithm == compressionGzip {
+			if dr, err = gzip.NewReader(bytes.NewReader(compressed)); err != nil {
+				t.Fatalf("%s: %v", algorithm, err)
+			}
+		} else {
+			dr = brotli.NewReader(bytes.NewReader(compressed))
+		}
+		plain, err := io.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if string(plain) != content {
+			t.Errorf("%s: decompressed content differs", algorithm)
+		}
+	}
+}
+
+func TestCompressReaderClose(t *testing.T) {
+	r := compressReader(strings.NewReader(strings.Repeat("x", 1<<20)), compressionGzip)
+	buf := make([]byte, 10)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// closing early must not block the compressing goroutine
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(buf); err == nil {
+		t.Error("expected error reading a closed reader")
+	}
+}
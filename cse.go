@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Client-side encryption encrypts every file with its own random AES-256 data
+// key. The content is split into segments sealed with AES-GCM, each under a
+// nonce made of a random per-file prefix, the segment index and a flag marking
+// the final segment, so segments can neither be reordered nor truncated. The
+// data key is sealed with a key encryption key from a key file or derived from
+// a passphrase, and stored with the nonce prefix in the object metadata. Sync
+// mode compares files by an HMAC of their content under a key derived from the
+// key encryption key, as a plain MD5 would reveal guessable files.
+const (
+	cseAlgorithm     = "AES-256-GCM-64K"
+	cseSegmentSize   = 64 * 1024
+	cseKeySize       = 32
+	cseNoncePrefix   = 7
+	cseKDFIterations = 600000
+
+	metaCSEAlgorithm  = "cse-algorithm"
+	metaCSEWrappedKey = "cse-wrapped-key"
+	metaCSENonce      = "cse-nonce"
+	metaCSESalt       = "cse-salt"
+	metaCSEMAC        = "cse-mac"
+)
+
+var errCSEKeyMissing = errors.New("object is client-side encrypted but no client encryption key is configured")
+
+// clientEncryption holds the key encryption key material of a run.
+type clientEncryption struct {
+	passphrase string
+
+	// key encryption key used for uploads, and the salt it was derived with
+	// when using a passphrase
+	kek  []byte
+	salt []byte
+
+	// keys derived for the salts of downloaded objects
+	mu      sync.Mutex
+	derived map[string][]byte
+}
+
+func newClientEncryption(passphrase, keyFile string) (*clientEncryption, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, fmt.Errorf("client_encryption_passphrase and client_encryption_key_file are mutually exclusive")
+	}
+
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client_encryption_key_file: %w", err)
+		}
+		kek, err := decodeKey(data, cseKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("client_encryption_key_file: %w", err)
+		}
+		return &clientEncryption{kek: kek}, nil
+	}
+
+	c := &clientEncryption{
+		passphrase: passphrase,
+		salt:       make([]byte, 16),
+		derived:    map[string][]byte{},
+	}
+	if _, err := rand.Read(c.salt); err != nil {
+		return nil, err
+	}
+	kek, err := c.keyFor(c.salt)
+	if err != nil {
+		return nil, err
+	}
+	c.kek = kek
+	return c, nil
+}
+
+// keyFor returns the key encryption key for an object stored with salt.
+func (c *clientEncryption) keyFor(salt []byte) ([]byte, error) {
+	if c.passphrase == "" {
+		if len(salt) != 0 {
+			return nil, fmt.Errorf("object key was derived from a passphrase, but a key file is configured")
+		}
+		return c.kek, nil
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("object key was sealed with a key file, but a passphrase is configured")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if kek, ok := c.derived[string(salt)]; ok {
+		return kek, nil
+	}
+	kek, err := pbkdf2.Key(sha256.New, c.passphrase, salt, cseKDFIterations, cseKeySize)
+	if err != nil {
+		return nil, err
+	}
+	c.derived[string(salt)] = kek
+	return kek, nil
+}
+
+// objectKey returns the key encryption key of an object stored with metadata.
+func (c *clientEncryption) objectKey(metadata map[string]string) ([]byte, error) {
+	salt, err := base64.StdEncoding.DecodeString(metadata[metaCSESalt])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	return c.keyFor(salt)
+}
+
+// contentMAC returns the hex HMAC-SHA256 of the file at path under a key
+// derived from kek.
+func contentMAC(kek []byte, path string) (string, error) {
+	key, err := hkdf.Key(sha256.New, kek, nil, "drone-s3 content mac", cseKeySize)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hmac.New(sha256.New, key)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the encrypted form of the size bytes of src together with the
+// metadata needed to decrypt it again.
+func (c *clientEncryption) seal(src io.ReaderAt, size int64) (*io.SectionReader, map[string]string, error) {
+	dataKey := make([]byte, cseKeySize)
+	prefix := make([]byte, cseNoncePrefix)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, nil, err
+	}
+
+	wrapper, err := newGCM(c.kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyNonce := make([]byte, wrapper.NonceSize())
+	if _, err := rand.Read(keyNonce); err != nil {
+		return nil, nil, err
+	}
+	wrapped := wrapper.Seal(keyNonce, keyNonce, dataKey, []byte(cseAlgorithm))
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := map[string]string{
+		metaCSEAlgorithm:  cseAlgorithm,
+		metaCSEWrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		metaCSENonce:      base64.StdEncoding.EncodeToString(prefix),
+	}
+	if len(c.salt) > 0 {
+		metadata[metaCSESalt] = base64.StdEncoding.EncodeToString(c.salt)
+	}
+
+	r := &sealedReaderAt{src: src, size: size, aead: aead, prefix: prefix, cached: -1}
+	return io.NewSectionReader(r, 0, sealedSize(size)), metadata, nil
+}
+
+// open returns a reader decrypting src, which was sealed with metadata.
+func (c *clientEncryption) open(src io.Reader, metadata map[string]string) (io.Reader, error) {
+	if alg := metadata[metaCSEAlgorithm]; alg != cseAlgorithm {
+		return nil, fmt.Errorf("unsupported client encryption algorithm '%s'", alg)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[metaCSEWrappedKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	prefix, err := base64.StdEncoding.DecodeString(metadata[metaCSENonce])
+	if err != nil || len(prefix) != cseNoncePrefix {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	kek, err := c.objectKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+	wrapper, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < wrapper.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	dataKey, err := wrapper.Open(nil, wrapped[:wrapper.NonceSize()], wrapped[wrapper.NonceSize():], []byte(cseAlgorithm))
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key, wrong client encryption key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{src: bufio.NewReader(src), aead: aead, prefix: prefix}, nil
+}
+
+// sealedSize is the length of the encrypted form of size bytes. Empty content
+// still produces a single, empty final segment.
+func sealedSize(size int64) int64 {
+	segments := max((size+cseSegmentSize-1)/cseSegmentSize, 1)
+	return size + segments*16
+}
+
+func segmentNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cseNoncePrefix:], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealedReaderAt encrypts segments of src on demand, so the encrypted content
+// can be read concurrently at any offset, as multipart uploads do.
+type sealedReaderAt struct {
+	src    io.ReaderAt
+	size   int64
+	aead   cipher.AEAD
+	prefix []byte
+
+	mu     sync.Mutex
+	cached int64
+	sealed []byte
+}
+
+func (s *sealedReaderAt) segment(index int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index == s.cached {
+		return s.sealed, nil
+	}
+
+	start := index * cseSegmentSize
+	length := min(s.size-start, cseSegmentSize)
+	plain := make([]byte, length)
+	if _, err := s.src.ReadAt(plain, start); err != nil && !(errors.Is(err, io.EOF) && length == 0) {
+		return nil, err
+	}
+
+	final := start+length >= s.size
+	s.sealed = s.aead.Seal(nil, segmentNonce(s.prefix, uint32(index), final), plain, nil)
+	s.cached = index
+	return s.sealed, nil
+}
+
+func (s *sealedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	total := sealedSize(s.size)
+	n := 0
+	for n < len(p) && off < total {
+		sealedSegment := int64(cseSegmentSize + s.aead.Overhead())
+		sealed, err := s.segment(off / sealedSegment)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], sealed[off%sealedSegment:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// openReader decrypts a stream of sealed segments.
+type openReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+
+	index uint32
+	plain []byte
+	done  bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	sealed := make([]byte, cseSegmentSize+o.aead.Overhead())
+	n, err := io.ReadFull(o.src, sealed)
+	final := false
+	switch {
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("client encrypted content is truncated")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := o.src.Peek(1); errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := o.aead.Open(sealed[:0], segmentNonce(o.prefix, o.index, final), sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt segment %d: %w", o.index, err)
+	}
+	o.plain = plain
+	o.index++
+	o.done = final
+	return nil
+}
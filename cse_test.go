@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientEncryptionRoundTrip(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "cse.key")
+	key := make([]byte, cseKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	withKeyFile, err := newClientEncryption("", keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	withPassphrase, err := newClientEncryption("correct horse battery staple", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sizes := []int{0, 1, cseSegmentSize - 1, cseSegmentSize, cseSegmentSize + 1, 3*cseSegmentSize + 17}
+	for _, c := range []*clientEncryption{withKeyFile, withPassphrase} {
+		for _, size := range sizes {
+			plain := make([]byte, size)
+			if _, err := rand.Read(plain); err != nil {
+				t.Fatal(err)
+			}
+
+			sealed, metadata, err := c.seal(bytes.NewReader(plain), int64(size))
+			if err != nil {
+				t.Fatalf("size %d: seal failed: %v", size, err)
+			}
+			if sealed.Size() != sealedSize(int64(size)) {
+				t.Fatalf("size %d: expected sealed size %d, got %d", size, sealedSize(int64(size)), sealed.Size())
+			}
+			ciphertext, err := io.ReadAll(sealed)
+			if err != nil {
+				t.Fatalf("size %d: read failed: %v", size, err)
+			}
+			if int64(len(ciphertext)) != sealed.Size() {
+				t.Fatalf("size %d: expected %d bytes, read %d", size, sealed.Size(), len(ciphertext))
+			}
+
+			r, err := c.open(bytes.NewReader(ciphertext), metadata)
+			if err != nil {
+				t.Fatalf("size %d: open failed: %v", size, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("size %d: decrypt failed: %v", size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d: round trip changed the content", size)
+			}
+		}
+	}
+}
+
+func TestClientEncryptionRejectsTampering(t *testing.T) {
+	c, err := newClientEncryption("secret", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	plain := bytes.Repeat([]byte("a"), 2*cseSegmentSize)
+	sealed, metadata, err := c.seal(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	ciphertext, _ := io.ReadAll(sealed)
+
+	decrypt := func(c *clientEncryption, data []byte) error {
+		r, err := c.open(bytes.NewReader(data), metadata)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+
+	// dropping the final segment must not pass as a shorter file
+	if err := decrypt(c, ciphertext[:cseSegmentSize+16]); err == nil {
+		t.Error("expected truncated content to fail")
+	}
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[10] ^= 1
+	if err := decrypt(c, flipped); err == nil {
+		t.Error("expected modified content to fail")
+	}
+
+	other, err := newClientEncryption("wrong", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := decrypt(other, ciphertext); err == nil {
+		t.Error("expected wrong passphrase to fail")
+	}
+}
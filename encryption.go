@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// kmsKeyPattern matches the KMS key identifiers S3 accepts: a key ID, a key
+// ARN, an alias name or an alias ARN.
+var kmsKeyPattern = regexp.MustCompile(`^(` +
+	`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}` +
+	`|mrk-[0-9a-fA-F]{32}` +
+	`|alias/[a-zA-Z0-9/_-]+` +
+	`|arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:(key/[0-9a-zA-Z-]+|alias/[a-zA-Z0-9/_-]+)` +
+	`)$`)
+
+func isKMSEncryption(encryption string) bool {
+	return encryption == string(s3types.ServerSideEncryptionAwsKms) ||
+		encryption == string(s3types.ServerSideEncryptionAwsKmsDsse)
+}
+
+// validateKMS checks the SSE-KMS options and prepares the encryption context
+// in the base64 encoded JSON form S3 expects. An empty encryption defaults to
+// aws:kms when any KMS option is set. Only the form of the key ID is checked,
+// whether the key exists and may be used is up to S3 on the first upload.
+func (p *Plugin) validateKMS() error {
+	if p.KMSKeyID == "" && p.KMSEncryptionContext == "" && !p.BucketKeyEnabled {
+		return nil
+	}
+
+	if p.Encryption == "" {
+		p.Encryption = string(s3types.ServerSideEncryptionAwsKms)
+	}
+	if !isKMSEncryption(p.Encryption) {
+		return fmt.Errorf("kms_key_id, kms_encryption_context and bucket_key_enabled require encryption 'aws:kms' or 'aws:kms:dsse', got '%s'", p.Encryption)
+	}
+
+	if p.KMSKeyID != "" && !kmsKeyPattern.MatchString(p.KMSKeyID) {
+		return fmt.Errorf("kms_key_id '%s' is not a KMS key ID, key ARN, alias or alias ARN", p.KMSKeyID)
+	}
+
+	if p.KMSEncryptionContext == "" {
+		return nil
+	}
+	pairs := map[string]string{}
+	if err := json.Unmarshal([]byte(p.KMSEncryptionContext), &pairs); err != nil {
+		return fmt.Errorf("kms_encryption_context must be a JSON object of strings: %w", err)
+	}
+	encoded, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	p.kmsContext = base64.StdEncoding.EncodeToString(encoded)
+	return nil
+}
+
+// sseCustomerKeySize is the size of the AES-256 key SSE-C expects.
+const sseCustomerKeySize = 32
+
+// decodeKey returns the key held in a key file, either as raw bytes of the
+// expected size or base64 encoded.
+func decodeKey(data []byte, size int) ([]byte, error) {
+	if len(data) == size {
+		return data, nil
+	}
+	return decodeBase64Key(string(bytes.TrimSpace(data)), size)
+}
+
+func decodeBase64Key(encoded string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64 encoded: %w", err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("key must be %d bytes, got %d bytes", size, len(key))
+	}
+	return key, nil
+}
+
+// loadSSECustomerKey reads the SSE-C key from SSECustomerKey or
+// SSECustomerKeyFile and prepares its base64 form and MD5 digest.
+func (p *Plugin) loadSSECustomerKey() error {
+	if p.SSECustomerKey == "" && p.SSECustomerKeyFile == "" {
+		return nil
+	}
+	if p.SSECustomerKey != "" && p.SSECustomerKeyFile != "" {
+		return fmt.Errorf("sse_customer_key and sse_customer_key_file are mutually exclusive")
+	}
+
+	if p.Encryption != "" || p.KMSKeyID != "" || p.KMSEncryptionContext != "" || p.BucketKeyEnabled {
+		return fmt.Errorf("sse_customer_key cannot be combined with other server-side encryption options")
+	}
+
+	var key []byte
+	if p.SSECustomerKeyFile != "" {
+		data, err := os.ReadFile(p.SSECustomerKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read sse_customer_key_file: %w", err)
+		}
+		if key, err = decodeKey(data, sseCustomerKeySize); err != nil {
+			return fmt.Errorf("sse_customer_key_file: %w", err)
+		}
+	} else {
+		var err error
+		if key, err = decodeBase64Key(p.SSECustomerKey, sseCustomerKeySize); err != nil {
+			return fmt.Errorf("sse_customer_key: %w", err)
+		}
+	}
+
+	sum := md5.Sum(key)
+	p.sseCustomerKey = base64.StdEncoding.EncodeToString(key)
+	p.sseCustomerKeyMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	return nil
+}
+
+// sseCustomerHeaders returns the SSE-C algorithm, key and key MD5 to send
+// with every request that reads or writes object content, or nils when no
+// customer key is configured.
+func (p *Plugin) sseCustomerHeaders() (algorithm, key, keyMD5 *string) {
+	if p.sseCustomerKey == "" {
+		return nil, nil, nil
+	}
+	return aws.String(string(s3types.ServerSideEncryptionAes256)), aws.String(p.sseCustomerKey), aws.String(p.sseCustomerKeyMD5)
+}
+
+// applyEncryption sets the server-side encryption options on an upload.
+// encryption and kmsKeyID are resolved per file and default to the plugin
+// options.
+func (p *Plugin) applyEncryption(input *s3.PutObjectInput, encryption, kmsKeyID string) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = p.sseCustomerHeaders()
+
+	if encryption != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryption(encryption)
+	}
+
+	if !isKMSEncryption(encryption) {
+		return
+	}
+
+	if kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+
+	if p.kmsContext != "" {
+		input.SSEKMSEncryptionContext = aws.String(p.kmsContext)
+	}
+
+	if p.BucketKeyEnabled {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+}
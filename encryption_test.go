@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateKMS(t *testing.T) {
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		expectError bool
+		encryption  string
+		context     string
+	}{
+		{
+			name:       "no kms options",
+			plugin:     Plugin{Encryption: "AES256"},
+			encryption: "AES256",
+		},
+		{
+			name:       "key defaults to aws:kms",
+			plugin:     Plugin{KMSKeyID: "alias/builds"},
+			encryption: "aws:kms",
+		},
+		{
+			name:       "key arn",
+			plugin:     Plugin{Encryption: "aws:kms", KMSKeyID: "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"},
+			encryption: "aws:kms",
+		},
+		{
+			name:       "key id",
+			plugin:     Plugin{Encryption: "aws:kms:dsse", KMSKeyID: "1234abcd-12ab-34cd-56ef-1234567890ab"},
+			encryption: "aws:kms:dsse",
+		},
+		{
+			name:        "malformed key",
+			plugin:      Plugin{Encryption: "aws:kms", KMSKeyID: "my key"},
+			expectError: true,
+		},
+		{
+			name:        "key with AES256",
+			plugin:      Plugin{Encryption: "AES256", KMSKeyID: "alias/builds"},
+			expectError: true,
+		},
+		{
+			name:       "encryption context",
+			plugin:     Plugin{KMSEncryptionContext: `{"project": "drone"}`},
+			encryption: "aws:kms",
+			context:    `{"project":"drone"}`,
+		},
+		{
+			name:        "invalid encryption context",
+			plugin:      Plugin{KMSEncryptionContext: `project=drone`},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.plugin
+			err := p.validateKMS()
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.Encryption != tc.encryption {
+				t.Errorf("expected encryption %q, got %q", tc.encryption, p.Encryption)
+			}
+			if tc.context != "" {
+				decoded, _ := base64.StdEncoding.DecodeString(p.kmsContext)
+				if string(decoded) != tc.context {
+					t.Errorf("expected context %s, got %s", tc.context, decoded)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSSECustomerKey(t *testing.T) {
+	key := make([]byte, sseCustomerKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	sum := md5.Sum(key)
+	expectedMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	dir := t.TempDir()
+	rawFile := filepath.Join(dir, "raw.key")
+	if err := os.WriteFile(rawFile, key, 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	encodedFile := filepath.Join(dir, "encoded.key")
+	if err := os.WriteFile(encodedFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		expectError bool
+	}{
+		{name: "inline key", plugin: Plugin{SSECustomerKey: encoded}},
+		{name: "raw key file", plugin: Plugin{SSECustomerKeyFile: rawFile}},
+		{name: "base64 key file", plugin: Plugin{SSECustomerKeyFile: encodedFile}},
+		{name: "short key", plugin: Plugin{SSECustomerKey: base64.StdEncoding.EncodeToString(key[:16])}, expectError: true},
+		{name: "not base64", plugin: Plugin{SSECustomerKey: "not a key"}, expectError: true},
+		{name: "both sources", plugin: Plugin{SSECustomerKey: encoded, SSECustomerKeyFile: rawFile}, expectError: true},
+		{name: "with sse-s3", plugin: Plugin{SSECustomerKey: encoded, Encryption: "AES256"}, expectError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := tc.plugin
+			err := p.loadSSECustomerKey()
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if p.sseCustomerKey != encoded || p.sseCustomerKeyMD5 != expectedMD5 {
+				t.Errorf("unexpected key %q with md5 %q", p.sseCustomerKey, p.sseCustomerKeyMD5)
+			}
+		})
+	}
+}
+
+func TestSSECustomerKeyRequests(t *testing.T) {
+	key := make([]byte, sseCustomerKeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	p := &Plugin{Bucket: "bucket", SSECustomerKey: base64.StdEncoding.EncodeToString(key), MultipartThreshold: 1}
+	if err := p.loadSSECustomerKey(); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploadFakeFile(t, p, server, upload{target: "small.bin"}, 1024)
+	uploadFakeFile(t, p, server, upload{target: "large.bin"}, 6*mib)
+	p.Target = t.TempDir()
+	if _, err := p.downloadS3Object(context.Background(), newFakeS3Client(server), "", "small.bin", "small.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, operation := range []string{"PutObject", "CreateMultipartUpload", "UploadPart", "GetObject"} {
+		requests := fake.received(operation)
+		if len(requests) == 0 {
+			t.Errorf("%s: no request", operation)
+		}
+		for _, r := range requests {
+			if got := r.header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"); got != "AES256" {
+				t.Errorf("%s %s: expected algorithm AES256, got '%s'", operation, r.key, got)
+			}
+			if got := r.header.Get("X-Amz-Server-Side-Encryption-Customer-Key"); got != p.sseCustomerKey {
+				t.Errorf("%s %s: expected customer key, got '%s'", operation, r.key, got)
+			}
+			if got := r.header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"); got != p.sseCustomerKeyMD5 {
+				t.Errorf("%s %s: expected customer key MD5, got '%s'", operation, r.key, got)
+			}
+		}
+	}
+	if n := len(fake.received("UploadPart")); n != 2 {
+		t.Errorf("expected 2 parts, got %d", n)
+	}
+}
+
+func TestKMSRequests(t *testing.T) {
+	p := &Plugin{
+		Bucket:               "bucket",
+		KMSKeyID:             "alias/deploy",
+		KMSEncryptionContext: `{"team": "web"}`,
+		BucketKeyEnabled:     true,
+		MultipartThreshold:   1,
+	}
+	if err := p.validateKMS(); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	uploadFakeFile(t, p, server, upload{target: "small.bin", encryption: p.Encryption, kmsKeyID: p.KMSKeyID}, 1024)
+	uploadFakeFile(t, p, server, upload{target: "large.bin", encryption: p.Encryption, kmsKeyID: p.KMSKeyID}, 6*mib)
+
+	expected := map[string]string{
+		"X-Amz-Server-Side-Encryption":                    "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id":     "alias/deploy",
+		"X-Amz-Server-Side-Encryption-Context":            base64.StdEncoding.EncodeToString([]byte(`{"team":"web"}`)),
+		"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled": "true",
+	}
+	for _, operation := range []string{"PutObject", "CreateMultipartUpload"} {
+		requests := fake.received(operation)
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", operation, len(requests))
+		}
+		for name, value := range expected {
+			if got := requests[0].header.Get(name); got != value {
+				t.Errorf("%s: expected %s '%s', got '%s'", operation, name, value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// Kinds of credential and client setup failures. Errors returned by
+// createS3Client wrap one of them, so they can be told apart with errors.Is.
+var (
+	errMissingCredentials = errors.New("no usable AWS credentials")
+	errSTSDenied          = errors.New("STS denied the request")
+	errInvalidEndpoint    = errors.New("invalid endpoint")
+)
+
+// clientError is a failure to set up credentials or the S3 client.
+type clientError struct {
+	kind error
+	err  error
+}
+
+func (e *clientError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *clientError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// stsError classifies a failed STS request. Error responses from STS reject
+// the caller, its token or the requested role, anything else such as network
+// failures is returned as is.
+func stsError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return &clientError{kind: errSTSDenied, err: err}
+	}
+	return err
+}
+
+// credentialsError classifies a failure to load or retrieve credentials.
+func credentialsError(err error) error {
+	var opErr *smithy.OperationError
+	if errors.As(err, &opErr) && opErr.ServiceID == sts.ServiceID {
+		return stsError(err)
+	}
+	return &clientError{kind: errMissingCredentials, err: err}
+}
+
+// configError classifies a failure to load the AWS config. A missing profile
+// leaves the plugin without credentials, other failures are returned as is.
+func configError(err error) error {
+	var notExist config.SharedConfigProfileNotExistError
+	if errors.As(err, &notExist) {
+		return &clientError{kind: errMissingCredentials, err: err}
+	}
+	return err
+}
+
+// validateEndpoint checks that a normalized endpoint is an http(s) URL.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return &clientError{kind: errInvalidEndpoint, err: err}
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &clientError{kind: errInvalidEndpoint, err: fmt.Errorf("'%s' is not an http or https URL with a host", endpoint)}
+	}
+	return nil
+}
+
+// exitCode maps the error kinds to distinct exit codes, so pipelines can
+// react to them without parsing the log.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errMissingCredentials):
+		return 2
+	case errors.Is(err, errSTSDenied):
+		return 3
+	case errors.Is(err, errInvalidEndpoint):
+		return 4
+	}
+	return 1
+}
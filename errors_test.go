@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// isolateAWSEnv removes credentials and config of the test environment, so
+// the default credential chain finds nothing.
+func isolateAWSEnv(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY",
+		"AWS_SESSION_TOKEN",
+		"AWS_PROFILE",
+		"AWS_ROLE_ARN",
+		"AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	tests := map[string]bool{
+		"https://s3.example.com":       true,
+		"http://localhost:9000":        true,
+		"https://":                     false,
+		"ftp://files.example.com":      false,
+		"https://bad host.example.com": false,
+	}
+	for endpoint, valid := range tests {
+		err := validateEndpoint(endpoint)
+		if valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", endpoint, err)
+		}
+		if !valid && !errors.Is(err, errInvalidEndpoint) {
+			t.Errorf("%s: expected errInvalidEndpoint, got %v", endpoint, err)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{errors.New("upload failed"), 1},
+		{&clientError{kind: errMissingCredentials, err: errors.New("none")}, 2},
+		{fmt.Errorf("wrapped: %w", &clientError{kind: errSTSDenied, err: errors.New("denied")}), 3},
+		{&clientError{kind: errInvalidEndpoint, err: errors.New("bad")}, 4},
+	}
+	for _, tc := range tests {
+		if got := exitCode(tc.err); got != tc.expected {
+			t.Errorf("%v: expected exit code %d, got %d", tc.err, tc.expected, got)
+		}
+	}
+}
+
+func TestCreateS3ClientInvalidEndpoint(t *testing.T) {
+	isolateAWSEnv(t)
+	p := &Plugin{Region: "us-east-1", Key: "AKID", Secret: "secret", Endpoint: "ftp://files.example.com"}
+	if _, err := p.createS3Client(context.Background()); !errors.Is(err, errInvalidEndpoint) {
+		t.Errorf("expected errInvalidEndpoint, got %v", err)
+	}
+}
+
+func TestCreateS3ClientMissingCredentials(t *testing.T) {
+	isolateAWSEnv(t)
+
+	p := &Plugin{Region: "us-east-1"}
+	if _, err := p.createS3Client(context.Background()); !errors.Is(err, errMissingCredentials) {
+		t.Errorf("expected errMissingCredentials, got %v", err)
+	}
+
+	p = &Plugin{Region: "us-east-1", Profile: "missing"}
+	if _, err := p.createS3Client(context.Background()); !errors.Is(err, errMissingCredentials) {
+		t.Errorf("expected errMissingCredentials for unknown profile, got %v", err)
+	}
+
+	// dry runs do not need credentials
+	p = &Plugin{Region: "us-east-1", DryRun: true}
+	if _, err := p.createS3Client(context.Background()); err != nil {
+		t.Errorf("unexpected error in dry run: %v", err)
+	}
+}
+
+func TestCreateS3ClientSTSDenied(t *testing.T) {
+	isolateAWSEnv(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized to perform sts:AssumeRole</Message></Error><RequestId>1</RequestId></ErrorResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	p := &Plugin{
+		Region:                "us-east-1",
+		AssumeRole:            "arn:aws:iam::123456789012:role/deploy",
+		AssumeRoleSessionName: "drone",
+	}
+	_, err := p.createS3Client(context.Background())
+	if !errors.Is(err, errSTSDenied) {
+		t.Errorf("expected errSTSDenied, got %v", err)
+	}
+	if exitCode(err) != 3 {
+		t.Errorf("expected exit code 3, got %d", exitCode(err))
+	}
+}
+
+func TestExecValidatesBeforeClient(t *testing.T) {
+	isolateAWSEnv(t)
+
+	tests := []struct {
+		name   string
+		plugin Plugin
+	}{
+		{name: "part size", plugin: Plugin{Region: "us-east-1", Bucket: "bucket", Source: "*.txt", PartSize: 1}},
+		{name: "compression", plugin: Plugin{Region: "us-east-1", Bucket: "bucket", Source: "*.txt", Compression: "zip"}},
+		{name: "checksum", plugin: Plugin{Region: "us-east-1", Bucket: "bucket", Source: "dist/", Download: true, Checksum: "md4"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.plugin.Exec()
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if errors.Is(err, errMissingCredentials) {
+				t.Errorf("expected a configuration error, got %v", err)
+			}
+		})
+	}
+}
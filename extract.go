@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveFormat returns the archive format of an object key by its
+// extension, or "" when the object is not an archive.
+func archiveFormat(key string) string {
+	key = strings.ToLower(key)
+	switch {
+	case strings.HasSuffix(key, ".tar.gz"), strings.HasSuffix(key, ".tgz"):
+		return archiveTarGzip
+	case strings.HasSuffix(key, ".tar.zst"), strings.HasSuffix(key, ".tzst"):
+		return archiveTarZstd
+	case strings.HasSuffix(key, ".zip"):
+		return archiveZip
+	}
+	return ""
+}
+
+// extractTar unpacks a compressed tar stream into dir. Entries are written as
+// they are read, so the archive is never stored on disk.
+func extractTar(r io.Reader, format, dir string) (int, error) {
+	var zr io.Reader
+	if format == archiveTarZstd {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer d.Close()
+		zr = d
+	} else {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		zr = gz
+	}
+
+	x := extractor{dir: dir}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return x.files, err
+		}
+		if err := x.extract(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, tr); err != nil {
+			return x.files, err
+		}
+	}
+	return x.files, x.finish()
+}
+
+// extractZip unpacks the zip archive in r into dir. Zip archives keep their
+// index at the end, so they are read from the downloaded file.
+func extractZip(r io.ReaderAt, size int64, dir string) (int, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, err
+	}
+
+	x := extractor{dir: dir}
+	for _, f := range zr.File {
+		if err := x.extractZipFile(f); err != nil {
+			return x.files, err
+		}
+	}
+	return x.files, x.finish()
+}
+
+// extractor writes archive entries below dir, refusing entries that would
+// escape it.
+type extractor struct {
+	dir   string
+	files int
+
+	// directory mtimes are restored last, as writing their files changes them
+	dirs []extractedDir
+}
+
+type extractedDir struct {
+	path  string
+	mtime time.Time
+}
+
+func (x *extractor) extractZipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("archive entry '%s': %w", f.Name, err)
+	}
+	defer rc.Close()
+	return x.extract(f.Name, f.Mode(), f.Modified, rc)
+}
+
+func (x *extractor) extract(name string, mode os.FileMode, mtime time.Time, r io.Reader) error {
+	rel := strings.TrimSuffix(filepath.ToSlash(name), "/")
+	if mode.IsDir() && (rel == "" || rel == ".") {
+		return nil
+	}
+	path, err := containedPath(x.dir, rel)
+	if err != nil {
+		return fmt.Errorf("archive entry '%s': %w", name, err)
+	}
+
+	switch {
+	case mode.IsDir():
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			return err
+		}
+		// keep directories writable so their remaining entries can be extracted
+		if err := os.Chmod(path, mode.Perm()|0o700); err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, extractedDir{path: path, mtime: mtime})
+		return nil
+	case mode.IsRegular():
+		if err := writeExtracted(path, r, mode.Perm(), mtime); err != nil {
+			return fmt.Errorf("archive entry '%s': %w", name, err)
+		}
+		x.files++
+		return nil
+	default:
+		// links could point outside of dir, and devices or pipes have no place
+		// in a download
+		slog.Warn("Skipping unsupported archive entry", "name", name, "type", mode.Type().String())
+		return nil
+	}
+}
+
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(x.dirs[i].path, x.dirs[i].mtime, x.dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveExtracted moves the entries extracted into staging over dir. Existing
+// directories are merged and take the mode and mtime of the archive entry,
+// existing files are replaced.
+func moveExtracted(staging, dir string) error {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(staging, entry.Name())
+		dst := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if stat, err := os.Lstat(dst); err == nil && stat.IsDir() {
+				// moving the entries out changes the mtime of src
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				if err := moveExtracted(src, dst); err != nil {
+					return err
+				}
+				if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+					return err
+				}
+				if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExtracted writes the content of r to path with the given mode and
+// modification time, through a temporary file like regular downloads.
+func writeExtracted(path string, r io.Reader, mode os.FileMode, mtime time.Time) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directories: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	tests := map[string]string{
+		"cache/deps.tar.gz":  archiveTarGzip,
+		"cache/deps.TGZ":     archiveTarGzip,
+		"cache/deps.tar.zst": archiveTarZstd,
+		"cache/deps.tzst":    archiveTarZstd,
+		"release/site.zip":   archiveZip,
+		"release/site.gz":    "",
+		"index.html":         "",
+	}
+	for key, expected := range tests {
+		if got := archiveFormat(key); got != expected {
+			t.Errorf("%s: expected '%s', got '%s'", key, expected, got)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"index.html":        "<html></html>",
+		"assets/js/app.js":  "console.log(1)",
+		"assets/css/a.css":  "body {}",
+		"assets/empty.json": "",
+	}
+	var entries []archiveEntry
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, archiveEntry{path: path, name: name})
+	}
+
+	for _, format := range []string{archiveTarGzip, archiveTarZstd, archiveZip} {
+		var buf bytes.Buffer
+		if err := writeArchive(&buf, format, entries); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		dir := t.TempDir()
+		var count int
+		var err error
+		if format == archiveZip {
+			count, err = extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dir)
+		} else {
+			count, err = extractTar(&buf, format, dir)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if count != len(files) {
+			t.Errorf("%s: expected %d files, got %d", format, len(files), count)
+		}
+
+		for name, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("%s: %v", format, err)
+				continue
+			}
+			if string(data) != content {
+				t.Errorf("%s %s: expected content %q, got %q", format, name, content, data)
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stat.ModTime().Equal(modTime) {
+				t.Errorf("%s %s: expected mtime %v, got %v", format, name, modTime, stat.ModTime())
+			}
+			if runtime.GOOS != "windows" && stat.Mode().Perm() != 0o750 {
+				t.Errorf("%s %s: expected mode 0750, got %v", format, name, stat.Mode().Perm())
+			}
+		}
+	}
+}
+
+func writeTarGzip(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTarContainment(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "/etc/evil.txt", "a/../../evil.txt"} {
+		root := t.TempDir()
+		dir := filepath.Join(root, "target")
+		archive := writeTarGzip(t, &tar.Header{Name: name, Mode: 0o644, Size: 1, Typeflag: tar.TypeReg})
+		if _, err := extractTar(archive, archiveTarGzip, dir); err == nil {
+			t.Errorf("%s: expected error for entry escaping the target", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "evil.txt")); err == nil {
+			t.Errorf("%s: file written outside the target", name)
+		}
+	}
+}
+
+func TestExtractTarSkipsLinks(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTarGzip(t,
+		&tar.Header{Name: "passwd", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink},
+		&tar.Header{Name: "data.txt", Mode: 0o644, Size: 3, Typeflag: tar.TypeReg},
+	)
+	count, err := extractTar(archive, archiveTarGzip, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 file, got %d", count)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "passwd")); err == nil {
+		t.Error("expected symlink entry to be skipped")
+	}
+}
+
+func TestMoveExtracted(t *testing.T) {
+	staging := t.TempDir()
+	dir := t.TempDir()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	write := func(root, name, content string) {
+		t.Helper()
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(staging, "assets/app.js", "new")
+	write(staging, "index.html", "new")
+	write(staging, "docs/readme.md", "new")
+	if err := os.Chtimes(filepath.Join(staging, "assets"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	write(dir, "assets/keep.css", "old")
+	write(dir, "index.html", "old")
+
+	if err := moveExtracted(staging, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"assets/app.js":   "new",
+		"assets/keep.css": "old",
+		"index.html":      "new",
+		"docs/readme.md":  "new",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(data) != content {
+			t.Errorf("%s: expected content %q, got %q", name, content, data)
+		}
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "assets")); err != nil || !stat.ModTime().Equal(modTime) {
+		t.Errorf("expected merged directory to take the archive mtime, got %v", err)
+	}
+}
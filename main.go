@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli"
@@ -57,6 +59,47 @@ func main() {
 			Usage:  "external ID to use when assuming secondary role",
 			EnvVar: "PLUGIN_USER_ROLE_EXTERNAL_ID",
 		},
+		cli.DurationFlag{
+			Name:   "assume-role-duration",
+			Usage:  "duration of assumed role sessions",
+			Value:  time.Hour,
+			EnvVar: "PLUGIN_ASSUME_ROLE_DURATION",
+		},
+		cli.StringFlag{
+			Name:   "assume-role-session-tags",
+			Usage:  "json object of session tags for assumed roles",
+			EnvVar: "PLUGIN_ASSUME_ROLE_SESSION_TAGS",
+		},
+		cli.StringSliceFlag{
+			Name:   "assume-role-transitive-tag-keys",
+			Usage:  "session tag keys passed on to chained roles",
+			EnvVar: "PLUGIN_ASSUME_ROLE_TRANSITIVE_TAG_KEYS",
+		},
+		cli.StringFlag{
+			Name:   "assume-role-source-identity",
+			Usage:  "source identity set on assumed role sessions",
+			EnvVar: "PLUGIN_ASSUME_ROLE_SOURCE_IDENTITY",
+		},
+		cli.StringFlag{
+			Name:   "assume-role-policy",
+			Usage:  "inline json session policy for assumed roles",
+			EnvVar: "PLUGIN_ASSUME_ROLE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "named profile from the shared AWS config and credentials files",
+			EnvVar: "PLUGIN_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "shared-config-file",
+			Usage:  "path of the shared AWS config file",
+			EnvVar: "PLUGIN_SHARED_CONFIG_FILE",
+		},
+		cli.StringFlag{
+			Name:   "shared-credentials-file",
+			Usage:  "path of the shared AWS credentials file",
+			EnvVar: "PLUGIN_SHARED_CREDENTIALS_FILE",
+		},
 		cli.StringFlag{
 			Name:   "bucket",
 			Usage:  "aws bucket",
@@ -93,11 +136,51 @@ func main() {
 			Usage:  "ignore files matching exclude pattern",
 			EnvVar: "PLUGIN_EXCLUDE",
 		},
+		cli.StringSliceFlag{
+			Name:   "include",
+			Usage:  "only download objects matching include pattern",
+			EnvVar: "PLUGIN_INCLUDE",
+		},
 		cli.StringFlag{
 			Name:   "encryption",
 			Usage:  "server-side encryption algorithm, defaults to none",
 			EnvVar: "PLUGIN_ENCRYPTION",
 		},
+		cli.StringFlag{
+			Name:   "kms-key-id",
+			Usage:  "kms key for aws:kms server-side encryption, defaults to the aws managed key",
+			EnvVar: "PLUGIN_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "kms-encryption-context",
+			Usage:  "json object of the kms encryption context",
+			EnvVar: "PLUGIN_KMS_ENCRYPTION_CONTEXT",
+		},
+		cli.BoolFlag{
+			Name:   "bucket-key-enabled",
+			Usage:  "use an s3 bucket key for aws:kms server-side encryption",
+			EnvVar: "PLUGIN_BUCKET_KEY_ENABLED",
+		},
+		cli.StringFlag{
+			Name:   "sse-customer-key",
+			Usage:  "base64 encoded aes-256 key for sse-c encryption",
+			EnvVar: "PLUGIN_SSE_CUSTOMER_KEY",
+		},
+		cli.StringFlag{
+			Name:   "sse-customer-key-file",
+			Usage:  "file containing the sse-c key",
+			EnvVar: "PLUGIN_SSE_CUSTOMER_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "client-encryption-passphrase",
+			Usage:  "passphrase for client-side encryption of uploaded files",
+			EnvVar: "PLUGIN_CLIENT_ENCRYPTION_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name:   "client-encryption-key-file",
+			Usage:  "file containing the key for client-side encryption of uploaded files",
+			EnvVar: "PLUGIN_CLIENT_ENCRYPTION_KEY_FILE",
+		},
 		cli.BoolFlag{
 			Name:   "download",
 			Usage:  "switch to download mode, which will fetch `source`'s files from s3 bucket",
@@ -131,6 +214,43 @@ func main() {
 			EnvVar: "PLUGIN_CACHE_CONTROL",
 			Value:  &StringMapFlag{},
 		},
+		cli.GenericFlag{
+			Name:   "metadata",
+			Usage:  "set user metadata for uploaded objects",
+			EnvVar: "PLUGIN_METADATA",
+			Value:  &KeyValueMapFlag{},
+		},
+		cli.GenericFlag{
+			Name:   "tags",
+			Usage:  "set object tags for uploaded objects",
+			EnvVar: "PLUGIN_TAGS",
+			Value:  &KeyValueMapFlag{},
+		},
+		cli.StringFlag{
+			Name:   "compression",
+			Usage:  "compress uploaded files with gzip or br",
+			EnvVar: "PLUGIN_COMPRESSION",
+		},
+		cli.StringSliceFlag{
+			Name:   "compress-include",
+			Usage:  "only compress files matching compress-include pattern",
+			EnvVar: "PLUGIN_COMPRESS_INCLUDE",
+		},
+		cli.StringFlag{
+			Name:   "archive",
+			Usage:  "upload all matched files as a single tar.gz, tar.zst or zip object at target",
+			EnvVar: "PLUGIN_ARCHIVE",
+		},
+		cli.BoolFlag{
+			Name:   "extract",
+			Usage:  "extract downloaded tar.gz, tar.zst and zip objects",
+			EnvVar: "PLUGIN_EXTRACT",
+		},
+		cli.StringFlag{
+			Name:   "rules-file",
+			Usage:  "YAML or JSON file with ordered per-file upload rules",
+			EnvVar: "PLUGIN_RULES_FILE",
+		},
 		cli.StringFlag{
 			Name:   "storage-class",
 			Usage:  "set storage class to choose the best backend",
@@ -150,16 +270,90 @@ func main() {
 			Usage:  "OIDC token for assuming role via web identity",
 			EnvVar: "PLUGIN_OIDC_TOKEN_ID",
 		},
+		cli.StringFlag{
+			Name:   "oidc-token-file",
+			Usage:  "file holding the OIDC token for assuming role via web identity, read on every refresh",
+			EnvVar: "PLUGIN_OIDC_TOKEN_FILE",
+		},
 		cli.StringFlag{
 			Name:   "session-token",
 			Usage:  "aws session token for temporary credentials (e.g., from EKS Pod Identity, IRSA, STS)",
 			EnvVar: "PLUGIN_SESSION_TOKEN,AWS_SESSION_TOKEN",
 		},
+		cli.IntFlag{
+			Name:   "parallelism",
+			Usage:  "number of files to upload or download concurrently",
+			Value:  1,
+			EnvVar: "PLUGIN_PARALLELISM",
+		},
+		cli.Int64Flag{
+			Name:   "part-size",
+			Usage:  "size in MiB of each part of a multipart upload",
+			Value:  16,
+			EnvVar: "PLUGIN_PART_SIZE",
+		},
+		cli.Int64Flag{
+			Name:   "multipart-threshold",
+			Usage:  "upload files of at least this many MiB in parts, 0 disables multipart uploads",
+			Value:  64,
+			EnvVar: "PLUGIN_MULTIPART_THRESHOLD",
+		},
+		cli.BoolFlag{
+			Name:   "sync",
+			Usage:  "only upload files that are missing or changed in the bucket",
+			EnvVar: "PLUGIN_SYNC",
+		},
+		cli.BoolFlag{
+			Name:   "delete",
+			Usage:  "delete objects below target that have no matching local file",
+			EnvVar: "PLUGIN_DELETE",
+		},
+		cli.IntFlag{
+			Name:   "max-deletes",
+			Usage:  "maximum number of objects delete may remove in one run, 0 disables the limit",
+			Value:  1000,
+			EnvVar: "PLUGIN_MAX_DELETES",
+		},
+		cli.StringFlag{
+			Name:   "checksum",
+			Usage:  "verify transferred content with a sha256 or crc32c checksum",
+			EnvVar: "PLUGIN_CHECKSUM",
+		},
+		cli.StringFlag{
+			Name:   "build.number",
+			Usage:  "build number",
+			EnvVar: "DRONE_BUILD_NUMBER",
+		},
+		cli.StringFlag{
+			Name:   "build.link",
+			Usage:  "build link",
+			EnvVar: "DRONE_BUILD_LINK",
+		},
+		cli.StringFlag{
+			Name:   "repo.name",
+			Usage:  "repository full name",
+			EnvVar: "DRONE_REPO",
+		},
+		cli.StringFlag{
+			Name:   "commit.branch",
+			Usage:  "git commit branch",
+			EnvVar: "DRONE_COMMIT_BRANCH,DRONE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "commit.tag",
+			Usage:  "git tag",
+			EnvVar: "DRONE_TAG",
+		},
+		cli.StringFlag{
+			Name:   "commit.sha",
+			Usage:  "git commit sha",
+			EnvVar: "DRONE_COMMIT_SHA",
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
 		slog.Error("application error", "error", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -169,31 +363,70 @@ func run(c *cli.Context) error {
 	}
 
 	plugin := Plugin{
-		Endpoint:              c.String("endpoint"),
-		Key:                   c.String("access-key"),
-		Secret:                c.String("secret-key"),
-		AssumeRole:            c.String("assume-role"),
-		AssumeRoleSessionName: c.String("assume-role-session-name"),
-		Bucket:                c.String("bucket"),
-		UserRoleArn:           c.String("user-role-arn"),
-		UserRoleExternalID:    c.String("user-role-external-id"),
-		Region:                c.String("region"),
-		Access:                c.String("acl"),
-		Source:                c.String("source"),
-		Target:                c.String("target"),
-		StripPrefix:           c.String("strip-prefix"),
-		Exclude:               c.StringSlice("exclude"),
-		Encryption:            c.String("encryption"),
-		ContentType:           c.Generic("content-type").(*StringMapFlag).Get(),
-		Download:              c.Bool("download"),
-		ContentEncoding:       c.Generic("content-encoding").(*StringMapFlag).Get(),
-		CacheControl:          c.Generic("cache-control").(*StringMapFlag).Get(),
-		StorageClass:          c.String("storage-class"),
-		PathStyle:             c.Bool("path-style"),
-		DryRun:                c.Bool("dry-run"),
-		ExternalID:            c.String("external-id"),
-		IdToken:               c.String("oidc-token-id"),
-		SessionToken:          c.String("session-token"),
+		Endpoint:                    c.String("endpoint"),
+		Key:                         c.String("access-key"),
+		Secret:                      c.String("secret-key"),
+		AssumeRole:                  c.String("assume-role"),
+		AssumeRoleSessionName:       c.String("assume-role-session-name"),
+		Bucket:                      c.String("bucket"),
+		UserRoleArn:                 c.String("user-role-arn"),
+		UserRoleExternalID:          c.String("user-role-external-id"),
+		AssumeRoleDuration:          c.Duration("assume-role-duration"),
+		AssumeRoleSessionTags:       c.String("assume-role-session-tags"),
+		AssumeRoleTransitiveTagKeys: c.StringSlice("assume-role-transitive-tag-keys"),
+		AssumeRoleSourceIdentity:    c.String("assume-role-source-identity"),
+		AssumeRolePolicy:            c.String("assume-role-policy"),
+		Profile:                     c.String("profile"),
+		SharedConfigFile:            c.String("shared-config-file"),
+		SharedCredentialsFile:       c.String("shared-credentials-file"),
+		Region:                      c.String("region"),
+		Access:                      c.String("acl"),
+		Source:                      c.String("source"),
+		Target:                      c.String("target"),
+		StripPrefix:                 c.String("strip-prefix"),
+		Exclude:                     c.StringSlice("exclude"),
+		Include:                     c.StringSlice("include"),
+		Encryption:                  c.String("encryption"),
+		KMSKeyID:                    c.String("kms-key-id"),
+		KMSEncryptionContext:        c.String("kms-encryption-context"),
+		BucketKeyEnabled:            c.Bool("bucket-key-enabled"),
+		SSECustomerKey:              c.String("sse-customer-key"),
+		SSECustomerKeyFile:          c.String("sse-customer-key-file"),
+		ClientEncryptionPassphrase:  c.String("client-encryption-passphrase"),
+		ClientEncryptionKeyFile:     c.String("client-encryption-key-file"),
+		ContentType:                 c.Generic("content-type").(*StringMapFlag).Get(),
+		Download:                    c.Bool("download"),
+		ContentEncoding:             c.Generic("content-encoding").(*StringMapFlag).Get(),
+		CacheControl:                c.Generic("cache-control").(*StringMapFlag).Get(),
+		Metadata:                    c.Generic("metadata").(*KeyValueMapFlag).Get(),
+		Tags:                        c.Generic("tags").(*KeyValueMapFlag).Get(),
+		RulesFile:                   c.String("rules-file"),
+		Compression:                 strings.ToLower(c.String("compression")),
+		CompressInclude:             c.StringSlice("compress-include"),
+		Archive:                     strings.ToLower(c.String("archive")),
+		Extract:                     c.Bool("extract"),
+		StorageClass:                c.String("storage-class"),
+		PathStyle:                   c.Bool("path-style"),
+		DryRun:                      c.Bool("dry-run"),
+		ExternalID:                  c.String("external-id"),
+		IdToken:                     c.String("oidc-token-id"),
+		IdTokenFile:                 c.String("oidc-token-file"),
+		SessionToken:                c.String("session-token"),
+		Parallelism:                 c.Int("parallelism"),
+		PartSize:                    c.Int64("part-size"),
+		MultipartThreshold:          c.Int64("multipart-threshold"),
+		Sync:                        c.Bool("sync"),
+		Delete:                      c.Bool("delete"),
+		MaxDeletes:                  c.Int("max-deletes"),
+		Checksum:                    strings.ToLower(c.String("checksum")),
+		Build: Build{
+			Number: c.String("build.number"),
+			Link:   c.String("build.link"),
+			Branch: c.String("commit.branch"),
+			Tag:    c.String("commit.tag"),
+			Commit: c.String("commit.sha"),
+			Repo:   c.String("repo.name"),
+		},
 	}
 
 	return plugin.Exec()
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mattn/go-zglob"
+)
+
+// maxDeleteBatch is the number of keys a single DeleteObjects call accepts.
+const maxDeleteBatch = 1000
+
+// listPrefix returns the key prefix listed for sync and delete: the literal
+// part of target before its first placeholder, cut back to a path segment
+// boundary. A target of docs lists docs/ and never siblings such as
+// docs-archive/.
+func listPrefix(target string) string {
+	prefix := templatePrefix(target)
+	if prefix == target && prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return prefix + "/"
+	}
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// validateDeleteTarget rejects targets whose first placeholder starts in the
+// middle of a path segment, as the objects of other targets sharing the
+// segment could not be told apart from stale ones.
+func validateDeleteTarget(target string) error {
+	prefix := templatePrefix(target)
+	if prefix != target && prefix != "" && !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("delete requires the placeholders of target to start a path segment, got '%s'", target)
+	}
+	return nil
+}
+
+// staleKeys returns the sorted keys of remote objects below prefix that are
+// neither in keep nor match one of the exclude patterns relative to prefix.
+func staleKeys(remote map[string]remoteObject, keep map[string]bool, prefix string, exclude []string) []string {
+	var stale []string
+	for key := range remote {
+		if keep[key] || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(key, prefix)
+		if matchesAny(exclude, rel) {
+			continue
+		}
+		stale = append(stale, key)
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := zglob.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteStale removes the objects below the target prefix that no longer
+// correspond to a local file.
+func (p *Plugin) deleteStale(ctx context.Context, client *s3.Client, remote map[string]remoteObject, keep map[string]bool) error {
+	prefix := listPrefix(p.Target)
+	stale := staleKeys(remote, keep, prefix, p.Exclude)
+	if len(stale) == 0 {
+		slog.Info("No stale objects to delete", "bucket", p.Bucket, "dir", prefix)
+		return nil
+	}
+
+	// dry runs list every key before reporting the limit a real run would hit
+	if p.DryRun {
+		for _, key := range stale {
+			slog.Info("Dry-run: would delete", "bucket", p.Bucket, "key", key)
+		}
+	}
+
+	if p.MaxDeletes > 0 && len(stale) > p.MaxDeletes {
+		return fmt.Errorf("refusing to delete %d objects below '%s', more than max_deletes (%d)", len(stale), prefix, p.MaxDeletes)
+	}
+
+	if p.DryRun {
+		return nil
+	}
+
+	var errs []error
+	for start := 0; start < len(stale); start += maxDeleteBatch {
+		end := min(start+maxDeleteBatch, len(stale))
+
+		objects := make([]s3types.ObjectIdentifier, 0, end-start)
+		for _, key := range stale[start:end] {
+			slog.Info("Deleting object", "bucket", p.Bucket, "key", key)
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(p.Bucket),
+			Delete: &s3types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			slog.Error("Could not delete objects", "error", err, "bucket", p.Bucket)
+			return err
+		}
+		for _, e := range out.Errors {
+			errs = append(errs, fmt.Errorf("delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+	}
+
+	if len(errs) > 0 {
+		slog.Error("Could not delete some objects", "bucket", p.Bucket, "failed", len(errs))
+		return errors.Join(errs...)
+	}
+
+	slog.Info("Deleted stale objects", "bucket", p.Bucket, "count", len(stale))
+	return nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestStaleKeys(t *testing.T) {
+	remote := map[string]remoteObject{
+		"site/index.html":      {},
+		"site/old.html":        {},
+		"site/css/app.css":     {},
+		"site/css/old.css":     {},
+		"site/maps/app.js.map": {},
+		"site-old/x.html":      {},
+		"site.html":            {},
+	}
+	keep := map[string]bool{
+		"site/index.html":  true,
+		"site/css/app.css": true,
+	}
+
+	tests := []struct {
+		name     string
+		exclude  []string
+		expected []string
+	}{
+		{
+			name:     "no exclude",
+			expected: []string{"site/css/old.css", "site/maps/app.js.map", "site/old.html"},
+		},
+		{
+			name:     "exclude keeps matching keys",
+			exclude:  []string{"**/*.map"},
+			expected: []string{"site/css/old.css", "site/old.html"},
+		},
+		{
+			name:     "exclude relative to target",
+			exclude:  []string{"css/*"},
+			expected: []string{"site/maps/app.js.map", "site/old.html"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := staleKeys(remote, keep, listPrefix("site"), tc.exclude)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestListPrefix(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"site":                      "site/",
+		"site/":                     "site/",
+		"site/{{ file.ext }}/x":     "site/",
+		"site-{{ file.ext }}":       "",
+		"docs/v-{{ file.ext }}/x":   "docs/",
+		"{{ file.ext }}/index.html": "",
+	}
+	for target, expected := range tests {
+		if got := listPrefix(target); got != expected {
+			t.Errorf("%s: expected '%s', got '%s'", target, expected, got)
+		}
+	}
+}
+
+func TestValidateDeleteTarget(t *testing.T) {
+	tests := map[string]bool{
+		"site":                  true,
+		"site/{{ file.ext }}":   true,
+		"{{ file.ext }}/x":      true,
+		"site-{{ file.ext }}":   false,
+		"site/v{{ file.ext }}/": false,
+	}
+	for target, valid := range tests {
+		err := validateDeleteTarget(target)
+		if valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", target, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected error", target)
+		}
+	}
+}
+
+// fakeListPage is the number of keys fakeS3 returns per ListObjectsV2 page,
+// the most S3 returns.
+const fakeListPage = 1000
+
+// fakeS3 lists, serves and heads objects with their metadata, accepts single
+// part and multipart uploads, and answers DeleteObjects requests, recording
+// the keys of every batch and reporting the keys in errors as failed. Every
+// request is recorded with its headers.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+	// etags replaces the MD5 ETag of objects
+	etags    map[string]string
+	pages    int
+	batches  [][]string
+	errors   map[string]string
+	requests []fakeRequest
+}
+
+// fakeRequest is a request received by fakeS3.
+type fakeRequest struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+}
+
+// operation names the S3 operation of the request.
+func (r fakeRequest) operation() string {
+	switch {
+	case r.method == http.MethodGet && r.query.Get("list-type") == "2":
+		return "ListObjectsV2"
+	case r.method == http.MethodGet:
+		return "GetObject"
+	case r.method == http.MethodHead:
+		return "HeadObject"
+	case r.method == http.MethodPost && r.query.Has("delete"):
+		return "DeleteObjects"
+	case r.method == http.MethodPost && r.query.Has("uploads"):
+		return "CreateMultipartUpload"
+	case r.method == http.MethodPut && r.query.Has("uploadId"):
+		return "UploadPart"
+	case r.method == http.MethodPut:
+		return "PutObject"
+	case r.method == http.MethodPost && r.query.Has("uploadId"):
+		return "CompleteMultipartUpload"
+	case r.method == http.MethodDelete && r.query.Has("uploadId"):
+		return "AbortMultipartUpload"
+	}
+	return ""
+}
+
+// received returns the recorded requests of an operation.
+func (f *fakeS3) received(operation string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var requests []fakeRequest
+	for _, r := range f.requests {
+		if r.operation() == operation {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// path style requests name the bucket in the first segment
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	req := fakeRequest{method: r.Method, key: key, query: r.URL.Query(), header: r.Header.Clone()}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+
+	switch req.operation() {
+	case "ListObjectsV2":
+		f.listObjects(w, r)
+	case "GetObject", "HeadObject":
+		f.getObject(w, key)
+	case "DeleteObjects":
+		f.deleteObjects(w, r)
+	case "PutObject", "UploadPart":
+		f.putObject(w, r, req)
+	case "CreateMultipartUpload":
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`, key)
+	case "CompleteMultipartUpload":
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Bucket>bucket</Bucket><Key>%s</Key><ETag>"multipart-2"</ETag></CompleteMultipartUploadResult>`, key)
+	case "AbortMultipartUpload":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+// putObject stores the body of single part uploads and acknowledges parts.
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, req fakeRequest) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.operation() == "PutObject" {
+		f.mu.Lock()
+		if f.objects == nil {
+			f.objects = map[string][]byte{}
+		}
+		f.objects[req.key] = body
+		f.mu.Unlock()
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+}
+
+func (f *fakeS3) listObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// continuation tokens are the index of the next key
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start > len(keys) {
+			http.Error(w, "invalid continuation token", http.StatusBadRequest)
+			return
+		}
+	}
+	end := min(start+fakeListPage, len(keys))
+	f.mu.Lock()
+	f.pages++
+	f.mu.Unlock()
+
+	var result strings.Builder
+	fmt.Fprintf(&result, "<KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys>", end-start, fakeListPage)
+	if end < len(keys) {
+		fmt.Fprintf(&result, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	} else {
+		result.WriteString("<IsTruncated>false</IsTruncated>")
+	}
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(&result, `<Contents><Key>%s</Key><Size>%d</Size><ETag>"%x"</ETag></Contents>`, key, len(f.objects[key]), md5.Sum(f.objects[key]))
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name>%s</ListBucketResult>`, result.String())
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	body, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		return
+	}
+	for name, value := range f.metadata[key] {
+		w.Header().Set("X-Amz-Meta-"+name, value)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	etag, ok := f.etags[key]
+	if !ok {
+		etag = fmt.Sprintf("%x", md5.Sum(body))
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Write(body)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var keys []string
+	var result strings.Builder
+	for _, object := range req.Objects {
+		keys = append(keys, object.Key)
+		if msg, ok := f.errors[object.Key]; ok {
+			fmt.Fprintf(&result, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>%s</Message></Error>", object.Key, msg)
+		}
+	}
+	f.mu.Lock()
+	f.batches = append(f.batches, keys)
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</DeleteResult>`, result.String())
+}
+
+// newFakeS3Client returns a client sending path-style requests to server.
+func newFakeS3Client(server *httptest.Server) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "secret", ""),
+	})
+}
+
+// uploadFakeFile uploads a file of size bytes through uploadFile to server,
+// in parts of the minimum size once size reaches the multipart threshold of p.
+func uploadFakeFile(t *testing.T, p *Plugin, server *httptest.Server, u upload, size int) {
+	t.Helper()
+	u.match = filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(u.match, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeS3Client(server)
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = manager.MinUploadPartSize
+	})
+	if err := p.uploadFile(context.Background(), client, uploader, u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// staleRemote returns n remote objects below site/ that have no local file.
+func staleRemote(n int) map[string]remoteObject {
+	remote := map[string]remoteObject{}
+	for i := range n {
+		remote[fmt.Sprintf("site/%04d.html", i)] = remoteObject{}
+	}
+	return remote
+}
+
+func TestDeleteStale(t *testing.T) {
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		objects     int
+		errors      map[string]string
+		batches     []int
+		dryRunKeys  int
+		expectError string
+	}{
+		{
+			name:        "max deletes",
+			plugin:      Plugin{MaxDeletes: 10},
+			objects:     11,
+			expectError: "more than max_deletes (10)",
+		},
+		{
+			name:       "dry run",
+			plugin:     Plugin{DryRun: true},
+			objects:    5,
+			dryRunKeys: 5,
+		},
+		{
+			name:        "dry run over max deletes",
+			plugin:      Plugin{DryRun: true, MaxDeletes: 10},
+			objects:     11,
+			dryRunKeys:  11,
+			expectError: "more than max_deletes (10)",
+		},
+		{
+			name:    "batches",
+			objects: 2500,
+			batches: []int{1000, 1000, 500},
+		},
+		{
+			name:    "per key errors",
+			objects: 3,
+			errors: map[string]string{
+				"site/0000.html": "Access Denied",
+				"site/0002.html": "Object Locked",
+			},
+			batches:     []int{3},
+			expectError: "delete site/0000.html: Access Denied\ndelete site/0002.html: Object Locked",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeS3{errors: tc.errors}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			var logs bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+			p := tc.plugin
+			p.Bucket = "bucket"
+			p.Target = "site"
+			err := p.deleteStale(context.Background(), newFakeS3Client(server), staleRemote(tc.objects), map[string]bool{})
+			if tc.expectError == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expectError != "" && (err == nil || !strings.Contains(err.Error(), tc.expectError)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectError, err)
+			}
+
+			var sizes []int
+			for _, batch := range fake.batches {
+				sizes = append(sizes, len(batch))
+			}
+			if !reflect.DeepEqual(sizes, tc.batches) {
+				t.Errorf("expected batches %v, got %v", tc.batches, sizes)
+			}
+			if got := strings.Count(logs.String(), "Dry-run: would delete"); got != tc.dryRunKeys {
+				t.Errorf("expected %d dry-run keys logged, got %d", tc.dryRunKeys, got)
+			}
+		})
+	}
+}
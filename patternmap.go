@@ -0,0 +1,178 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+)
+
+// filePatterns holds the compiled file patterns of the per-file upload
+// options. Every option orders its patterns by the same precedence, see
+// patternPrecedence.
+type filePatterns struct {
+	contentTypes     headerPatterns
+	contentEncodings headerPatterns
+	cacheControls    headerPatterns
+	metadata         pairPatterns
+	tags             pairPatterns
+}
+
+// compileFilePatterns compiles the file patterns of the per-file options once,
+// so invalid patterns are reported before anything is uploaded. The build
+// placeholders of metadata and tag values are filled in from values.
+func (p *Plugin) compileFilePatterns(values map[string]string) (*filePatterns, error) {
+	var f filePatterns
+	var err error
+	if f.contentTypes, err = compileHeaderPatterns("content_type", p.ContentType); err != nil {
+		return nil, err
+	}
+	if f.contentEncodings, err = compileHeaderPatterns("content_encoding", p.ContentEncoding); err != nil {
+		return nil, err
+	}
+	if f.cacheControls, err = compileHeaderPatterns("cache_control", p.CacheControl); err != nil {
+		return nil, err
+	}
+	if f.metadata, err = compilePairPatterns("metadata", p.Metadata, values); err != nil {
+		return nil, err
+	}
+	if f.tags, err = compilePairPatterns("tags", p.Tags, values); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// patternPrecedence orders file patterns by precedence. The longest pattern
+// comes first, so a catch-all like ".*" only applies to files no more specific
+// pattern matches. Patterns of equal length are ordered lexically.
+func patternPrecedence(a, b string) int {
+	return cmp.Or(cmp.Compare(len(b), len(a)), cmp.Compare(a, b))
+}
+
+// headerPattern maps the files matching re to a header value.
+type headerPattern struct {
+	pattern string
+	re      *regexp.Regexp
+	value   string
+}
+
+// headerPatterns holds the compiled patterns of a header option like
+// content_type, ordered by precedence.
+type headerPatterns []headerPattern
+
+// compileHeaderPatterns compiles the file patterns of a header option.
+func compileHeaderPatterns(option string, stringMap map[string]string) (headerPatterns, error) {
+	patterns := make(headerPatterns, 0, len(stringMap))
+	for pattern, value := range stringMap {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern '%s': %w", option, pattern, err)
+		}
+		patterns = append(patterns, headerPattern{pattern: pattern, re: re, value: value})
+	}
+	slices.SortFunc(patterns, func(a, b headerPattern) int {
+		return patternPrecedence(a.pattern, b.pattern)
+	})
+	return patterns, nil
+}
+
+// match returns the value of the first pattern matching the file, or "".
+func (h headerPatterns) match(path string) string {
+	for _, p := range h {
+		if p.re.MatchString(path) {
+			return p.value
+		}
+	}
+	return ""
+}
+
+// pairPattern maps the files matching re to key/value pairs.
+type pairPattern struct {
+	pattern string
+	re      *regexp.Regexp
+	pairs   map[string]string
+}
+
+// pairPatterns holds the compiled patterns of a pattern keyed option like
+// metadata or tags, ordered by precedence.
+type pairPatterns []pairPattern
+
+// compilePairPatterns checks the file patterns and value templates of a
+// pattern keyed option and compiles them, with the build placeholders of every
+// value filled in from values.
+func compilePairPatterns(option string, patternMap map[string]map[string]string, values map[string]string) (pairPatterns, error) {
+	patterns := make(pairPatterns, 0, len(patternMap))
+	for pattern, pairs := range patternMap {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern '%s': %w", option, pattern, err)
+		}
+		expanded := make(map[string]string, len(pairs))
+		for key, value := range pairs {
+			if key == "" {
+				return nil, fmt.Errorf("%s for pattern '%s' contains an empty key", option, pattern)
+			}
+			if err := validateTemplate(value, true); err != nil {
+				return nil, fmt.Errorf("%s '%s': %w", option, key, err)
+			}
+			expanded[key] = expandTemplate(value, values)
+		}
+		patterns = append(patterns, pairPattern{pattern: pattern, re: re, pairs: expanded})
+	}
+	slices.SortFunc(patterns, func(a, b pairPattern) int {
+		return patternPrecedence(a.pattern, b.pattern)
+	})
+	return patterns, nil
+}
+
+// match merges the pairs of every pattern matching the file, with the per-file
+// placeholders expanded for path. A key set by several patterns takes the value
+// of the pattern with the highest precedence, like header options do.
+func (pp pairPatterns) match(path string) map[string]string {
+	var merged, values map[string]string
+	for _, p := range pp {
+		if !p.re.MatchString(path) {
+			continue
+		}
+		if merged == nil {
+			merged, values = map[string]string{}, fileValues(path)
+		}
+		for key, value := range p.pairs {
+			if _, ok := merged[key]; !ok {
+				merged[key] = expandTemplate(value, values)
+			}
+		}
+	}
+	return merged
+}
+
+// mergeMaps returns base with the pairs of override applied on top, without
+// modifying either map.
+func mergeMaps(base, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return base
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, override)
+	return merged
+}
+
+// maxObjectTags is the number of tags S3 accepts on a single object.
+const maxObjectTags = 10
+
+// encodeTags returns tags in the URL query form PutObjectInput.Tagging expects.
+func encodeTags(tags map[string]string) (string, error) {
+	if len(tags) > maxObjectTags {
+		return "", fmt.Errorf("%d tags exceed the S3 limit of %d per object", len(tags), maxObjectTags)
+	}
+	query := url.Values{}
+	for key, value := range tags {
+		query.Set(key, value)
+	}
+	return query.Encode(), nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestKeyValueMapFlag(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    map[string]map[string]string
+		expectError bool
+	}{
+		{
+			value:    `{"\\.html$": {"page": "yes"}}`,
+			expected: map[string]map[string]string{`\.html$`: {"page": "yes"}},
+		},
+		{
+			value:    `{"commit": "abc"}`,
+			expected: map[string]map[string]string{".*": {"commit": "abc"}},
+		},
+		{
+			value:       `commit=abc`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		flag := &KeyValueMapFlag{}
+		err := flag.Set(tc.value)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.value, err)
+		} else if !reflect.DeepEqual(flag.Get(), tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.value, tc.expected, flag.Get())
+		}
+	}
+}
+
+func TestPairPatterns(t *testing.T) {
+	patterns, err := compilePairPatterns("metadata", map[string]map[string]string{
+		".*":      {"commit": "{{ commit.short }}", "kind": "file"},
+		`\.html$`: {"kind": "page", "name": "{{ file.base }}"},
+		`\.css$`:  {"kind": "style"},
+		`index`:   {"kind": "home", "section": "root"},
+	}, map[string]string{"commit.short": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the longest pattern wins a key, like with header options
+	got := patterns.match("dist/index.html")
+	expected := map[string]string{"commit": "abc", "kind": "page", "name": "index", "section": "root"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got = patterns.match("dist/site.css")
+	expected = map[string]string{"commit": "abc", "kind": "style"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	patterns, err = compilePairPatterns("metadata", map[string]map[string]string{`\.css$`: {"kind": "style"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := patterns.match("dist/app.js"); got != nil {
+		t.Errorf("expected no metadata, got %v", got)
+	}
+}
+
+func TestCompilePairPatterns(t *testing.T) {
+	if _, err := compilePairPatterns("metadata", map[string]map[string]string{"(": {"a": "b"}}, nil); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+	if _, err := compilePairPatterns("metadata", map[string]map[string]string{".*": {"": "b"}}, nil); err == nil {
+		t.Error("expected error for empty key")
+	}
+	if _, err := compilePairPatterns("metadata", map[string]map[string]string{".*": {"a": "{{ nope }}"}}, nil); err == nil {
+		t.Error("expected error for unknown placeholder")
+	}
+	if _, err := compilePairPatterns("metadata", map[string]map[string]string{".*": {"a": "{{ file.name }}"}}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	got, err := encodeTags(map[string]string{"team": "web platform", "env": "prod&test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "env=prod%26test&team=web+platform"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	tags := map[string]string{}
+	for i := 0; i <= maxObjectTags; i++ {
+		tags[string(rune('a'+i))] = "x"
+	}
+	if _, err := encodeTags(tags); err == nil {
+		t.Error("expected error for too many tags")
+	}
+}
+
+func TestCompileHeaderPatterns(t *testing.T) {
+	if _, err := compileHeaderPatterns("content_type", map[string]string{"(": "text/plain"}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+
+	patterns, err := compileHeaderPatterns("cache_control", map[string]string{
+		".*":         "no-cache",
+		`\.js$`:      "max-age=60",
+		`\.min\.js$`: "max-age=31536000",
+		`\.css$`:     "max-age=3600",
+		`\.cs`:       "private",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"dist/app.min.js": "max-age=31536000",
+		"dist/app.js":     "max-age=60",
+		"dist/site.css":   "max-age=3600",
+		"dist/index.html": "no-cache",
+	}
+	for path, expected := range tests {
+		if got := patterns.match(path); got != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+
+	var empty headerPatterns
+	if got := empty.match("index.html"); got != "" {
+		t.Errorf("expected no value, got %s", got)
+	}
+}
+
+func TestCompileHeaderPatternsTies(t *testing.T) {
+	patterns, err := compileHeaderPatterns("content_type", map[string]string{
+		`a\.txt$`: "text/a",
+		`\.txt$`:  "text/plain",
+		`^a\.txt`: "text/b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// equal length patterns are ordered lexically: `^a\.txt` before `a\.txt$`
+	if got := patterns.match("a.txt"); got != "text/b" {
+		t.Errorf("expected text/b, got %s", got)
+	}
+}
+
+func TestMetadataRequests(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	p := &Plugin{Bucket: "bucket", MultipartThreshold: 1}
+	metadata := map[string]string{"commit": "abc", "page": "index"}
+	uploadFakeFile(t, p, server, upload{target: "small.bin", metadata: metadata}, 1024)
+	uploadFakeFile(t, p, server, upload{target: "large.bin", metadata: metadata}, 6*mib)
+
+	for _, operation := range []string{"PutObject", "CreateMultipartUpload"} {
+		requests := fake.received(operation)
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", operation, len(requests))
+		}
+		for key, value := range metadata {
+			if got := requests[0].header.Get("X-Amz-Meta-" + key); got != value {
+				t.Errorf("%s: expected x-amz-meta-%s '%s', got '%s'", operation, key, value, got)
+			}
+		}
+	}
+}
+
+func TestTaggingRequests(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	tagging, err := encodeTags(map[string]string{"team": "web", "release": "v1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Plugin{Bucket: "bucket", MultipartThreshold: 1}
+	uploadFakeFile(t, p, server, upload{target: "small.bin", tagging: tagging}, 1024)
+	uploadFakeFile(t, p, server, upload{target: "large.bin", tagging: tagging}, 6*mib)
+
+	for _, operation := range []string{"PutObject", "CreateMultipartUpload"} {
+		requests := fake.received(operation)
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected 1 request, got %d", operation, len(requests))
+		}
+		if got := requests[0].header.Get("X-Amz-Tagging"); got != "release=v1.2&team=web" {
+			t.Errorf("%s: expected tagging 'release=v1.2&team=web', got '%s'", operation, got)
+		}
+	}
+	if n := len(fake.received("UploadPart")); n != 2 {
+		t.Errorf("expected 2 parts, got %d", n)
+	}
+}
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"mime"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
@@ -35,12 +42,68 @@ type Plugin struct {
 	UserRoleArn           string
 	UserRoleExternalID    string
 
+	// Session options for both AssumeRole and UserRoleArn: the duration
+	// (1 hour by default), session tags as a JSON object, the tag keys passed
+	// on to chained roles, the source identity and an inline session policy
+	AssumeRoleDuration          time.Duration
+	AssumeRoleSessionTags       string
+	AssumeRoleTransitiveTagKeys []string
+	AssumeRoleSourceIdentity    string
+	AssumeRolePolicy            string
+
+	// Named profile of the shared AWS config and credentials files, supports
+	// credential_process, SSO and source_profile chains
+	Profile string
+
+	// Paths of the shared config and credentials files, the SDK defaults
+	// (~/.aws/config and ~/.aws/credentials) are used when empty
+	SharedConfigFile      string
+	SharedCredentialsFile string
+
 	// if not "", enable server-side encryption
 	// valid values are:
 	//     AES256
 	//     aws:kms
+	//     aws:kms:dsse
 	Encryption string
 
+	// KMS key used with aws:kms encryption instead of the AWS managed key,
+	// as key ID, key ARN, alias name or alias ARN
+	KMSKeyID string
+
+	// JSON object of the SSE-KMS encryption context
+	KMSEncryptionContext string
+
+	// Use an S3 bucket key for SSE-KMS to reduce KMS requests
+	BucketKeyEnabled bool
+
+	// base64 encoded AES-256 key for SSE-C, applied to uploads and downloads
+	SSECustomerKey string
+
+	// File holding the SSE-C key, either base64 encoded or as raw 32 bytes
+	SSECustomerKeyFile string
+
+	// Encrypt files with AES-256-GCM before uploading and decrypt them when
+	// downloading, with a data key wrapped by a key derived from this passphrase
+	ClientEncryptionPassphrase string
+
+	// File holding the 32 byte key that wraps the client-side data keys, either
+	// base64 encoded or raw
+	ClientEncryptionKeyFile string
+
+	// base64 encoded KMSEncryptionContext, set by validateKMS
+	kmsContext string
+
+	// SSE-C key and its MD5, set by loadSSECustomerKey
+	sseCustomerKey    string
+	sseCustomerKeyMD5 string
+
+	// client-side encryption keys, set when either client encryption option is used
+	cse *clientEncryption
+
+	// parsed RulesFile
+	rules *Rules
+
 	// us-east-1
 	// us-west-1
 	// us-west-2
@@ -73,6 +136,19 @@ type Plugin struct {
 	// Sets the Cache-Control header on each uploaded object based on a extension map
 	CacheControl map[string]string
 
+	// Sets user metadata (x-amz-meta-*) on each uploaded object based on a
+	// extension map, values may contain target placeholders
+	Metadata map[string]map[string]string
+
+	// Sets object tags on each uploaded object based on a extension map,
+	// values may contain target placeholders
+	Tags map[string]map[string]string
+
+	// YAML or JSON file with ordered per-file rules for headers, metadata,
+	// tags, ACL, storage class and encryption, taking precedence over the
+	// options above, see rules.go
+	RulesFile string
+
 	// Sets the storage class, affects the storage backend costs
 	StorageClass string
 
@@ -85,15 +161,25 @@ type Plugin struct {
 	//    /path/to/*.txt
 	//    /path/to/*/*.txt
 	//    /path/to/**
+	//
+	// Target may contain placeholders like {{ build.tag }} or {{ file.ext }},
+	// see template.go for the full list.
 	Source string
 	Target string
 
-	// Strip the prefix from the target path (supports wildcards)
+	// Strip the prefix from the target path (supports wildcards and build placeholders)
 	StripPrefix string
 
+	// Pipeline metadata used to expand placeholders in Target and StripPrefix
+	Build Build
+
 	// Exclude files matching this pattern.
 	Exclude []string
 
+	// In download mode, only fetch objects whose key relative to `source`
+	// matches one of these patterns. All objects are fetched when empty.
+	Include []string
+
 	// Use path style instead of domain style.
 	//
 	// Should be true for minio and false for AWS.
@@ -107,12 +193,76 @@ type Plugin struct {
 	// set OIDC ID Token to retrieve temporary credentials
 	IdToken string
 
+	// File holding the OIDC ID Token, read again whenever the credentials
+	// are refreshed so rotated tokens are picked up
+	IdTokenFile string
+
 	// AWS session token for temporary credentials (e.g., from EKS Pod Identity, IRSA, STS)
 	SessionToken string
+
+	// Number of files transferred concurrently, values below 1 are treated as 1
+	Parallelism int
+
+	// Size in MiB of each part of a multipart upload, at least 5
+	PartSize int64
+
+	// Files of at least this many MiB are uploaded in parts, 0 disables multipart uploads
+	MultipartThreshold int64
+
+	// if true, only files that are missing or differ from the objects below `target` are uploaded
+	Sync bool
+
+	// if true, objects below `target` without a matching local file are deleted after uploading
+	Delete bool
+
+	// Maximum number of objects Delete may remove in a single run, 0 disables the limit
+	MaxDeletes int
+
+	// if not "", verify transferred content with this checksum algorithm
+	// valid values are:
+	//     sha256
+	//     crc32c
+	Checksum string
+
+	// if not "", compress uploaded files while streaming them and set their
+	// Content-Encoding, files in already compressed formats are skipped
+	// valid values are:
+	//     gzip
+	//     br
+	Compression string
+
+	// Only compress files matching one of these glob patterns, all by default
+	CompressInclude []string
+
+	// if not "", upload all matched files as a single archive object at `target`
+	// valid values are:
+	//     tar.gz
+	//     tar.zst
+	//     zip
+	Archive string
+
+	// if true, downloaded .tar.gz, .tar.zst and .zip objects are extracted into
+	// the directory they would be downloaded to instead of being stored
+	Extract bool
 }
 
+const mib = 1024 * 1024
+
 // Exec runs the plugin
 func (p *Plugin) Exec() error {
+	// an archive is a single object, so its key cannot depend on a file
+	if err := validateTemplate(p.Target, !p.Download && p.Archive == ""); err != nil {
+		slog.Error("Invalid target template", "error", err)
+		return err
+	}
+	if err := validateTemplate(p.StripPrefix, false); err != nil {
+		slog.Error("Invalid strip_prefix template", "error", err)
+		return err
+	}
+	values := buildValues(p.Build, time.Now().UTC())
+	p.Target = expandTemplate(p.Target, values)
+	p.StripPrefix = expandTemplate(p.StripPrefix, values)
+
 	if p.Download {
 		p.Source = normalizePath(p.Source)
 		p.Target = normalizePath(p.Target)
@@ -120,17 +270,55 @@ func (p *Plugin) Exec() error {
 		p.Target = strings.TrimPrefix(p.Target, "/")
 	}
 
+	if err := p.loadSSECustomerKey(); err != nil {
+		slog.Error("Invalid SSE-C settings", "error", err)
+		return err
+	}
+
+	if p.ClientEncryptionPassphrase != "" || p.ClientEncryptionKeyFile != "" {
+		cse, err := newClientEncryption(p.ClientEncryptionPassphrase, p.ClientEncryptionKeyFile)
+		if err != nil {
+			slog.Error("Invalid client encryption settings", "error", err)
+			return err
+		}
+		p.cse = cse
+	}
+
+	if err := validateChecksum(p.Checksum); err != nil {
+		return err
+	}
+
+	// configuration errors are reported before credentials are looked up
+	var patterns *filePatterns
+	if !p.Download {
+		var err error
+		if patterns, err = p.validateUpload(values); err != nil {
+			return err
+		}
+	}
+
 	ctx := context.Background()
 
-	client := p.createS3Client(ctx)
+	client, err := p.createS3Client(ctx)
+	if err != nil {
+		slog.Error("Cannot create S3 client", "error", err)
+		return err
+	}
 
 	if p.Download {
 		sourceDir := normalizePath(p.Source)
-		return p.downloadS3Objects(ctx, client, sourceDir)
+		_, _, err := p.downloadS3Objects(ctx, client, sourceDir)
+		return err
 	}
 
 	slog.Info("Attempting to upload", "region", p.Region, "endpoint", p.Endpoint, "bucket", p.Bucket)
 
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = p.PartSize * mib
+		// abort incomplete uploads so failed transfers do not leave orphaned parts
+		u.LeavePartsOnError = false
+	})
+
 	matches, err := matches(p.Source, p.Exclude)
 	if err != nil {
 		slog.Error("Could not match files", "error", err)
@@ -155,7 +343,24 @@ func (p *Plugin) Exec() error {
 		}
 	}
 
+	if p.Archive != "" {
+		return p.uploadArchive(ctx, uploader, matches, normalizedStrip, compiled, patterns)
+	}
+
+	var remote map[string]remoteObject
+	if (p.Sync && !p.DryRun) || p.Delete {
+		prefix := listPrefix(p.Target)
+		slog.Info("Listing S3 directory", "bucket", p.Bucket, "dir", prefix)
+		remote, err = listObjects(ctx, client, p.Bucket, prefix)
+		if err != nil {
+			slog.Error("Cannot list S3 directory", "error", err, "bucket", p.Bucket, "dir", prefix)
+			return err
+		}
+	}
+
 	anyMatched := false
+	keys := map[string]bool{}
+	var uploads []upload
 
 	for _, match := range matches {
 		if err := isDir(match, matches); err != nil {
@@ -166,42 +371,44 @@ func (p *Plugin) Exec() error {
 			return err
 		}
 
-		stripped := match
-		matched := false
-		if normalizedStrip != "" {
-			if strings.HasPrefix(normalizedStrip, "/") {
-				var err error
-				stripped, matched, err = stripWildcardPrefixWithRegex(match, normalizedStrip, compiled)
-				if err != nil {
-				slog.Warn("Failed to strip prefix, using original path", "error", err, "path", match, "pattern", p.StripPrefix)
-					stripped = match
-				}
-			} else {
-				m := filepath.ToSlash(match)
-				trimmed := strings.TrimPrefix(m, normalizedStrip)
-				if trimmed != m {
-					matched = true
-					stripped = trimmed
-				} else {
-					stripped = match
-				}
-			}
-		}
+		target, stripped, matched := p.objectKey(match, normalizedStrip, compiled)
 		if matched {
 			anyMatched = true
 		}
+		keys[target] = true
+
+		contentType := patterns.contentTypes.match(match)
+		contentEncoding := patterns.contentEncodings.match(match)
+		cacheControl := patterns.cacheControls.match(match)
+		metadata := patterns.metadata.match(match)
+		tags := patterns.tags.match(match)
+		acl, storageClass := p.Access, p.StorageClass
+		encryption, kmsKeyID := p.Encryption, p.KMSKeyID
+
+		if p.rules != nil {
+			rule := p.rules.resolve(match)
+			contentType = cmp.Or(rule.ContentType, contentType)
+			contentEncoding = cmp.Or(rule.ContentEncoding, contentEncoding)
+			cacheControl = cmp.Or(rule.CacheControl, cacheControl)
+			acl = cmp.Or(rule.ACL, acl)
+			storageClass = cmp.Or(rule.StorageClass, storageClass)
+			if rule.Encryption != "" {
+				encryption, kmsKeyID = rule.Encryption, rule.KMSKeyID
+			}
+			metadata = mergeMaps(metadata, rule.Metadata)
+			tags = mergeMaps(tags, rule.Tags)
+		}
 
-		var target string
-		if normalizedStrip != "" && !strings.HasPrefix(normalizedStrip, "/") {
-			target = resolveKey(p.Target, filepath.ToSlash(match), p.StripPrefix)
-		} else {
-			rel := strings.TrimPrefix(filepath.ToSlash(stripped), "/")
-			target = filepath.ToSlash(filepath.Join(p.Target, rel))
+		compression := p.compressFile(match, contentEncoding)
+		if compression != "" {
+			contentEncoding = compression
 		}
 
-		contentType := matchExtension(match, p.ContentType)
-		contentEncoding := matchExtension(match, p.ContentEncoding)
-		cacheControl := matchExtension(match, p.CacheControl)
+		tagging, err := encodeTags(tags)
+		if err != nil {
+			slog.Error("Invalid tags", "error", err, "file", match)
+			return fmt.Errorf("tags for '%s': %w", match, err)
+		}
 
 		if contentType == "" {
 			contentType = mime.TypeByExtension(filepath.Ext(match))
@@ -210,9 +417,8 @@ func (p *Plugin) Exec() error {
 			}
 		}
 
-		slog.Info("Uploading file", "name", match, "bucket", p.Bucket, "target", target)
-
 		if p.DryRun {
+			slog.Info("Uploading file", "name", match, "bucket", p.Bucket, "target", target)
 			removed := ""
 			if matched {
 				orig := filepath.ToSlash(match)
@@ -225,59 +431,338 @@ func (p *Plugin) Exec() error {
 				"target", target,
 				"strip_pattern", p.StripPrefix,
 				"removed_prefix", removed,
+				"compression", compression,
 			)
 			continue
 		}
 
-		f, err := os.Open(match)
-		if err != nil {
-		slog.Error("Problem opening file", "error", err, "file", match)
-			return err
+		u := upload{
+			match:           match,
+			target:          target,
+			contentType:     contentType,
+			contentEncoding: contentEncoding,
+			cacheControl:    cacheControl,
+			metadata:        metadata,
+			tagging:         tagging,
+			acl:             acl,
+			storageClass:    storageClass,
+			encryption:      encryption,
+			kmsKeyID:        kmsKeyID,
+			compression:     compression,
 		}
-		defer f.Close()
-
-		putObjectInput := &s3.PutObjectInput{
-			Body:   f,
-			Bucket: &(p.Bucket),
-			Key:    &target,
+		if obj, ok := remote[target]; ok {
+			u.remote = &obj
 		}
+		uploads = append(uploads, u)
+	}
 
-		if contentType != "" {
-			putObjectInput.ContentType = aws.String(contentType)
+	var uploaded, skipped atomic.Int64
+	err = forEachParallel(ctx, p.Parallelism, uploads, func(ctx context.Context, u upload) error {
+		if p.Sync {
+			same, err := p.unchanged(ctx, client, &u)
+			if err != nil {
+				return err
+			}
+			if same {
+				slog.Info("Skipping unchanged file", "name", u.match, "bucket", p.Bucket, "target", u.target)
+				skipped.Add(1)
+				return nil
+			}
 		}
-
-		if contentEncoding != "" {
-			putObjectInput.ContentEncoding = aws.String(contentEncoding)
+		if err := p.uploadFile(ctx, client, uploader, u); err != nil {
+			return err
 		}
+		uploaded.Add(1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.Sync {
+		slog.Info("Sync complete", "uploaded", uploaded.Load(), "skipped", skipped.Load())
+	}
 
-		if cacheControl != "" {
-			putObjectInput.CacheControl = aws.String(cacheControl)
+	if p.Delete {
+		// files hidden by exclude patterns keep their remote counterparts
+		all, err := zglob.Glob(p.Source)
+		if err != nil {
+			slog.Error("Could not match files", "error", err)
+			return err
 		}
+		included := map[string]bool{}
+		for _, match := range matches {
+			included[match] = true
+		}
+		for _, match := range all {
+			if !included[match] {
+				target, _, _ := p.objectKey(match, normalizedStrip, compiled)
+				keys[target] = true
+			}
+		}
+		if err := p.deleteStale(ctx, client, remote, keys); err != nil {
+			return err
+		}
+	}
+
+	if normalizedStrip != "" && !anyMatched {
+		slog.Warn("strip_prefix did not match any paths; keys will include original path", "pattern", p.StripPrefix)
+	}
+
+	return nil
+}
+
+// validateUpload checks the upload options, loads the rules file and
+// compiles the file patterns, so invalid settings fail the step before any
+// request is made.
+func (p *Plugin) validateUpload(values map[string]string) (*filePatterns, error) {
+	if err := validateCompression(p.Compression); err != nil {
+		return nil, err
+	}
+	if p.Compression != "" && p.cse != nil {
+		return nil, fmt.Errorf("compression cannot be combined with client-side encryption")
+	}
 
-		if p.Encryption != "" {
-			putObjectInput.ServerSideEncryption = s3types.ServerSideEncryption(p.Encryption)
+	if p.Delete {
+		if err := validateDeleteTarget(p.Target); err != nil {
+			return nil, err
 		}
+	}
 
-		if p.StorageClass != "" {
-			putObjectInput.StorageClass = s3types.StorageClass(p.StorageClass)
+	if err := p.validateArchiveOptions(); err != nil {
+		return nil, err
+	}
+
+	if err := p.validateKMS(); err != nil {
+		slog.Error("Invalid KMS encryption settings", "error", err)
+		return nil, err
+	}
+
+	if p.RulesFile != "" {
+		rules, err := loadRules(p.RulesFile)
+		if err != nil {
+			slog.Error("Invalid rules file", "error", err)
+			return nil, err
 		}
+		if p.sseCustomerKey != "" && rules.usesEncryption() {
+			return nil, fmt.Errorf("rules cannot set encryption together with sse_customer_key")
+		}
+		rules.expand(values)
+		p.rules = rules
+	}
+
+	patterns, err := p.compileFilePatterns(values)
+	if err != nil {
+		slog.Error("Invalid file pattern", "error", err)
+		return nil, err
+	}
+
+	if err := validatePartSize(p.PartSize); err != nil {
+		return nil, err
+	}
+
+	return patterns, nil
+}
+
+// objectKey resolves the key a matched file is uploaded to. stripped is the
+// path left once the strip prefix is removed and matched reports whether the
+// strip prefix applied to the file.
+func (p *Plugin) objectKey(match, normalizedStrip string, compiled *regexp.Regexp) (target, stripped string, matched bool) {
+	expanded := expandTemplate(p.Target, fileValues(match))
+	target, stripped, matched = p.keyBelow(expanded, match, normalizedStrip, compiled)
+	// a target naming the file is its whole key, the path of the file is not
+	// appended again
+	if namesFile(p.Target) {
+		target = strings.TrimPrefix(expanded, "/")
+	}
+	return target, stripped, matched
+}
 
-		if p.Access != "" {
-			putObjectInput.ACL = s3types.ObjectCannedACL(p.Access)
+// keyBelow resolves the key of match below prefix after stripping StripPrefix.
+func (p *Plugin) keyBelow(prefix, match, normalizedStrip string, compiled *regexp.Regexp) (target, stripped string, matched bool) {
+	stripped = match
+	if normalizedStrip != "" {
+		if strings.HasPrefix(normalizedStrip, "/") {
+			var err error
+			stripped, matched, err = stripWildcardPrefixWithRegex(match, normalizedStrip, compiled)
+			if err != nil {
+				slog.Warn("Failed to strip prefix, using original path", "error", err, "path", match, "pattern", p.StripPrefix)
+				stripped = match
+			}
+		} else {
+			m := filepath.ToSlash(match)
+			trimmed := strings.TrimPrefix(m, normalizedStrip)
+			if trimmed != m {
+				matched = true
+				stripped = trimmed
+			} else {
+				stripped = match
+			}
 		}
+	}
 
-		_, err = client.PutObject(ctx, putObjectInput)
+	if normalizedStrip != "" && !strings.HasPrefix(normalizedStrip, "/") {
+		target = resolveKey(prefix, filepath.ToSlash(match), p.StripPrefix)
+	} else {
+		rel := strings.TrimPrefix(filepath.ToSlash(stripped), "/")
+		target = filepath.ToSlash(filepath.Join(prefix, rel))
+	}
 
-		if err != nil {
-		slog.Error("Could not upload file", "name", match, "bucket", p.Bucket, "target", target, "error", err)
+	return target, stripped, matched
+}
+
+// upload describes a single local file and the resolved object it is
+// written to.
+type upload struct {
+	match           string
+	target          string
+	contentType     string
+	contentEncoding string
+	cacheControl    string
+	metadata        map[string]string
+	tagging         string
+	acl             string
+	storageClass    string
+	encryption      string
+	kmsKeyID        string
+	compression     string
+
+	// existing object at target, only looked up in sync mode
+	remote *remoteObject
+	// hex MD5 of the file, stored in the object metadata when known
+	md5 string
+	// hex MAC of the file replacing the MD5 with client-side encryption
+	mac string
+}
+
+// validatePartSize checks part_size whenever it is set, as the uploader also
+// splits compressed streams and archives into parts, not only files above
+// multipart_threshold. Zero keeps the default of the uploader.
+func validatePartSize(partSize int64) error {
+	if partSize != 0 && partSize*mib < manager.MinUploadPartSize {
+		return fmt.Errorf("part_size must be at least %d MiB", manager.MinUploadPartSize/mib)
+	}
+	return nil
+}
+
+func (p *Plugin) uploadFile(ctx context.Context, client *s3.Client, uploader *manager.Uploader, u upload) error {
+	slog.Info("Uploading file", "name", u.match, "bucket", p.Bucket, "target", u.target)
+
+	f, err := os.Open(u.match)
+	if err != nil {
+		slog.Error("Problem opening file", "error", err, "file", u.match)
+		return err
+	}
+	defer f.Close()
 
+	stat, err := f.Stat()
+	if err != nil {
+		slog.Error("Problem reading file info", "error", err, "file", u.match)
+		return err
+	}
+
+	var body io.ReadSeeker = f
+	size := stat.Size()
+	metadata := map[string]string{}
+	for key, value := range u.metadata {
+		metadata[key] = value
+	}
+	if u.md5 != "" {
+		metadata[md5MetadataKey] = u.md5
+	}
+	if u.mac != "" {
+		metadata[metaCSEMAC] = u.mac
+	}
+
+	if p.cse != nil {
+		sealed, envelope, err := p.cse.seal(f, size)
+		if err != nil {
+			slog.Error("Problem encrypting file", "error", err, "file", u.match)
 			return err
 		}
-		f.Close()
+		body = sealed
+		size = sealed.Size()
+		for key, value := range envelope {
+			metadata[key] = value
+		}
 	}
 
-	if normalizedStrip != "" && !anyMatched {
-		slog.Warn("strip_prefix did not match any paths; keys will include original path", "pattern", p.StripPrefix)
+	putObjectInput := &s3.PutObjectInput{
+		Body:          body,
+		Bucket:        &(p.Bucket),
+		Key:           aws.String(u.target),
+		ContentLength: aws.Int64(size),
+	}
+
+	if len(metadata) > 0 {
+		putObjectInput.Metadata = metadata
+	}
+
+	// multipart uploads pass the tags on to CreateMultipartUpload
+	if u.tagging != "" {
+		putObjectInput.Tagging = aws.String(u.tagging)
+	}
+
+	if u.contentType != "" {
+		putObjectInput.ContentType = aws.String(u.contentType)
+	}
+
+	if u.contentEncoding != "" {
+		putObjectInput.ContentEncoding = aws.String(u.contentEncoding)
+	}
+
+	if u.cacheControl != "" {
+		putObjectInput.CacheControl = aws.String(u.cacheControl)
+	}
+
+	p.applyEncryption(putObjectInput, u.encryption, u.kmsKeyID)
+
+	if u.storageClass != "" {
+		putObjectInput.StorageClass = s3types.StorageClass(u.storageClass)
+	}
+
+	if u.acl != "" {
+		putObjectInput.ACL = s3types.ObjectCannedACL(u.acl)
+	}
+
+	multipart := p.MultipartThreshold > 0 && size >= p.MultipartThreshold*mib
+
+	// the compressed size is not known up front, so the uploader buffers the
+	// stream and only switches to a multipart upload when it exceeds a part
+	streamed := u.compression != ""
+	if streamed {
+		compressed := compressReader(f, u.compression)
+		defer compressed.Close()
+		putObjectInput.Body = compressed
+		putObjectInput.ContentLength = nil
+	}
+
+	if p.Checksum != "" {
+		sum := ""
+		if !multipart && !streamed {
+			sum, err = readerChecksum(body, p.Checksum)
+			if err != nil {
+				slog.Error("Problem hashing file", "error", err, "file", u.match)
+				return err
+			}
+		}
+		applyChecksum(putObjectInput, p.Checksum, sum, multipart || streamed)
+	}
+
+	switch {
+	case streamed:
+		slog.Info("Compressing file", "name", u.match, "compression", u.compression)
+		_, err = uploader.Upload(ctx, putObjectInput)
+	case multipart:
+		slog.Info("Using multipart upload", "name", u.match, "size", size, "part_size", uploader.PartSize)
+		_, err = uploader.Upload(ctx, putObjectInput)
+	default:
+		_, err = client.PutObject(ctx, putObjectInput)
+	}
+
+	if err != nil {
+		slog.Error("Could not upload file", "name", u.match, "bucket", p.Bucket, "target", u.target, "error", err)
+		return fmt.Errorf("upload %s: %w", u.match, err)
 	}
 
 	return nil
@@ -314,35 +799,21 @@ func matches(include string, exclude []string) ([]string, error) {
 	return included, nil
 }
 
-func matchExtension(match string, stringMap map[string]string) string {
-	for pattern := range stringMap {
-		matched, err := regexp.MatchString(pattern, match)
-		if err != nil {
-			panic(err)
-		}
-		if matched {
-			return stringMap[pattern]
-		}
-	}
-	return ""
-}
-
-func assumeRole(ctx context.Context, roleArn, roleSessionName, externalID, region string) aws.CredentialsProvider {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// assumeRole returns credentials for roleArn, assumed with the credentials
+// loaded from the default chain and the given shared config options.
+func assumeRole(ctx context.Context, roleArn, externalID, region string, session *roleSession, optFns ...func(*config.LoadOptions) error) (aws.CredentialsProvider, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, append([]func(*config.LoadOptions) error{config.WithRegion(region)}, optFns...)...)
 	if err != nil {
-		slog.Error("failed to load AWS config for assume role", "error", err)
-		os.Exit(1)
+		return nil, configError(fmt.Errorf("failed to load AWS config for assume role: %w", err))
 	}
 	stsSvc := sts.NewFromConfig(cfg)
-	duration := time.Hour * 1
 	provider := stscreds.NewAssumeRoleProvider(stsSvc, roleArn, func(o *stscreds.AssumeRoleOptions) {
-		o.Duration = duration
-		o.RoleSessionName = roleSessionName
+		session.apply(o)
 		if externalID != "" {
 			o.ExternalID = &externalID
 		}
 	})
-	return aws.NewCredentialsCache(provider)
+	return aws.NewCredentialsCache(provider), nil
 }
 
 func resolveKey(target, srcPath, stripPrefix string) string {
@@ -388,69 +859,293 @@ func normalizePath(path string) string {
 	return strings.TrimPrefix(filepath.ToSlash(path), "/")
 }
 
-func (p *Plugin) downloadS3Object(ctx context.Context, client *s3.Client, sourceDir, key, target string) error {
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// containedPath joins the slash separated rel onto root, failing when rel is
+// absolute or would resolve to a location outside of root.
+func containedPath(root, rel string) (string, error) {
+	if rel == "" || strings.HasPrefix(rel, "/") || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("path '%s' escapes target directory '%s'", rel, root)
+	}
+	return filepath.Join(root, filepath.FromSlash(rel)), nil
+}
+
+func (p *Plugin) downloadS3Object(ctx context.Context, client *s3.Client, sourceDir, key, target string) (int64, error) {
+	// a source naming the object itself downloads it to target, archives are
+	// extracted into target
+	destination, extractDir := p.Target, p.Target
+	if target != "" {
+		var err error
+		destination, err = containedPath(p.Target, target)
+		if err != nil {
+			slog.Error("Refusing to download S3 object", "error", err, "bucket", p.Bucket, "key", key)
+			return 0, fmt.Errorf("object key '%s': %w", key, err)
+		}
+		extractDir = filepath.Dir(destination)
+	} else if p.Target == "" {
+		destination, extractDir = path.Base(key), "."
+	}
+
 	slog.Info("Getting S3 object", "bucket", p.Bucket, "key", key)
 
-	obj, err := client.GetObject(ctx, &s3.GetObjectInput{
+	getObjectInput := &s3.GetObjectInput{
 		Bucket: &p.Bucket,
 		Key:    &key,
-	})
+	}
+
+	if p.Checksum != "" {
+		getObjectInput.ChecksumMode = s3types.ChecksumModeEnabled
+	}
+
+	getObjectInput.SSECustomerAlgorithm, getObjectInput.SSECustomerKey, getObjectInput.SSECustomerKeyMD5 = p.sseCustomerHeaders()
+
+	obj, err := client.GetObject(ctx, getObjectInput)
 	if err != nil {
 		slog.Error("Cannot get S3 object", "error", err, "bucket", p.Bucket, "key", key)
-		return err
+		return 0, err
 	}
 	defer obj.Body.Close()
 
-	destination := filepath.Join(p.Target, target)
 	dir := filepath.Dir(destination)
 
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return fmt.Errorf("error creating directories: %w", err)
+		return 0, fmt.Errorf("error creating directories: %w", err)
 	}
 
-	f, err := os.Create(destination)
-	if err != nil {
-		slog.Error("Failed to create file", "error", err, "file", destination)
-		return err
+	format := ""
+	if p.Extract {
+		format = archiveFormat(key)
+	}
+	streamExtract := format == archiveTarGzip || format == archiveTarZstd
+
+	// archives are extracted into a staging directory next to their entries'
+	// destination and only moved into place once the object is verified
+	var staging string
+	if format != "" {
+		if err := os.MkdirAll(extractDir, os.ModePerm); err != nil {
+			return 0, fmt.Errorf("error creating directories: %w", err)
+		}
+		staging, err = os.MkdirTemp(extractDir, ".extract-*")
+		if err != nil {
+			slog.Error("Failed to create directory", "error", err, "dir", extractDir)
+			return 0, err
+		}
+		defer os.RemoveAll(staging)
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, obj.Body)
-	if err != nil {
+	// stream into a temporary file next to the destination so an interrupted
+	// transfer never leaves a truncated file behind
+	var f *os.File
+	committed := false
+	if !streamExtract {
+		f, err = os.CreateTemp(dir, "."+filepath.Base(destination)+".*.part")
+		if err != nil {
+			slog.Error("Failed to create file", "error", err, "file", destination)
+			return 0, err
+		}
+		defer func() {
+			if !committed {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}()
+	}
+
+	// hashes and length cover the bytes as stored, before any decryption
+	var n byteCounter
+	h := md5.New()
+	hashes := []io.Writer{&n, h}
+	var checksum hash.Hash
+	if p.Checksum != "" {
+		checksum = newChecksumHash(p.Checksum)
+		hashes = append(hashes, checksum)
+	}
+
+	var src io.Reader = io.TeeReader(obj.Body, io.MultiWriter(hashes...))
+	if obj.Metadata[metaCSEAlgorithm] != "" {
+		if p.cse == nil {
+			slog.Error("Cannot decrypt S3 object", "error", errCSEKeyMissing, "bucket", p.Bucket, "key", key)
+			return 0, fmt.Errorf("object '%s': %w", key, errCSEKeyMissing)
+		}
+		src, err = p.cse.open(src, obj.Metadata)
+		if err != nil {
+			slog.Error("Cannot decrypt S3 object", "error", err, "bucket", p.Bucket, "key", key)
+			return 0, fmt.Errorf("object '%s': %w", key, err)
+		}
+	}
+
+	if streamExtract {
+		slog.Info("Extracting archive", "bucket", p.Bucket, "key", key, "dir", extractDir)
+		files, err := extractTar(src, format, staging)
+		if err != nil {
+			slog.Error("Failed to extract archive", "error", err, "bucket", p.Bucket, "key", key)
+			return int64(n), fmt.Errorf("extract '%s': %w", key, err)
+		}
+		slog.Info("Extracted archive", "bucket", p.Bucket, "key", key, "files", files)
+		// read up to the end of the object so it is verified below
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return int64(n), err
+		}
+	} else if _, err := io.Copy(f, src); err != nil {
 		slog.Error("Failed to write file", "error", err, "file", destination)
-		return err
+		return int64(n), err
 	}
 
-	return nil
+	if obj.ContentLength != nil && int64(n) != *obj.ContentLength {
+		slog.Error("Incomplete S3 object", "bucket", p.Bucket, "key", key, "expected", *obj.ContentLength, "received", n)
+		return int64(n), fmt.Errorf("incomplete download of '%s': expected %d bytes, received %d", key, *obj.ContentLength, n)
+	}
+
+	if etag := strings.Trim(aws.ToString(obj.ETag), `"`); plainETag(etag, obj.ServerSideEncryption, obj.SSECustomerAlgorithm) {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(etag, sum) {
+			slog.Error("Checksum mismatch", "bucket", p.Bucket, "key", key, "etag", etag, "md5", sum)
+			return int64(n), fmt.Errorf("checksum mismatch for '%s': etag %s, received md5 %s", key, etag, sum)
+		}
+	}
+
+	if checksum != nil {
+		expected := objectChecksum(obj, p.Checksum)
+		if expected == "" {
+			slog.Warn("S3 object has no full object checksum, skipping verification", "bucket", p.Bucket, "key", key, "algorithm", p.Checksum)
+		} else if sum := encodeChecksum(checksum); sum != expected {
+			slog.Error("Checksum mismatch", "bucket", p.Bucket, "key", key, "algorithm", p.Checksum, "expected", expected, "received", sum)
+			return int64(n), fmt.Errorf("%s checksum mismatch for '%s': expected %s, received %s", p.Checksum, key, expected, sum)
+		}
+	}
+
+	if format == archiveZip {
+		stat, err := f.Stat()
+		if err != nil {
+			return int64(n), err
+		}
+		slog.Info("Extracting archive", "bucket", p.Bucket, "key", key, "dir", extractDir)
+		files, err := extractZip(f, stat.Size(), staging)
+		if err != nil {
+			slog.Error("Failed to extract archive", "error", err, "bucket", p.Bucket, "key", key)
+			return int64(n), fmt.Errorf("extract '%s': %w", key, err)
+		}
+		slog.Info("Extracted archive", "bucket", p.Bucket, "key", key, "files", files)
+	}
+
+	if format != "" {
+		if err := moveExtracted(staging, extractDir); err != nil {
+			slog.Error("Failed to move extracted files into place", "error", err, "bucket", p.Bucket, "key", key, "dir", extractDir)
+			return int64(n), fmt.Errorf("extract '%s': %w", key, err)
+		}
+		return int64(n), nil
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		slog.Error("Failed to write file", "error", err, "file", destination)
+		return int64(n), err
+	}
+	if err := f.Close(); err != nil {
+		slog.Error("Failed to write file", "error", err, "file", destination)
+		return int64(n), err
+	}
+	if err := os.Rename(f.Name(), destination); err != nil {
+		slog.Error("Failed to move file into place", "error", err, "file", destination)
+		os.Remove(f.Name())
+		committed = true
+		return int64(n), err
+	}
+	committed = true
+
+	return int64(n), nil
+}
+
+// wantObject reports whether the include and exclude patterns select the
+// object key, matched relative to the source prefix.
+func (p *Plugin) wantObject(sourceDir, key string) bool {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, sourceDir), "/")
+	if len(p.Include) > 0 && !matchesAny(p.Include, rel) {
+		return false
+	}
+	return !matchesAny(p.Exclude, rel)
 }
 
-func (p *Plugin) downloadS3Objects(ctx context.Context, client *s3.Client, sourceDir string) error {
+// downloadS3Objects downloads the wanted objects below sourceDir, returning
+// the number of objects and bytes received.
+func (p *Plugin) downloadS3Objects(ctx context.Context, client *s3.Client, sourceDir string) (int64, int64, error) {
 	slog.Info("Listing S3 directory", "bucket", p.Bucket, "dir", sourceDir)
 
-	list, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
 		Bucket: &p.Bucket,
 		Prefix: &sourceDir,
 	})
-	if err != nil {
-		slog.Error("Cannot list S3 directory", "error", err, "bucket", p.Bucket, "dir", sourceDir)
-		return err
-	}
 
-	for _, item := range list.Contents {
-		target := resolveSource(sourceDir, *item.Key, p.StripPrefix)
-		if err := p.downloadS3Object(ctx, client, sourceDir, *item.Key, target); err != nil {
-			return err
+	var count, size atomic.Int64
+	err := streamParallel(ctx, p.Parallelism, func(ctx context.Context, send func(string) bool) error {
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				slog.Error("Cannot list S3 directory", "error", err, "bucket", p.Bucket, "dir", sourceDir)
+				return err
+			}
+			for _, item := range page.Contents {
+				// folder placeholders have no content to write
+				if strings.HasSuffix(*item.Key, "/") || !p.wantObject(sourceDir, *item.Key) {
+					continue
+				}
+				if !send(*item.Key) {
+					return nil
+				}
+			}
+		}
+		return nil
+	}, func(ctx context.Context, key string) error {
+		target := resolveSource(sourceDir, key, p.StripPrefix)
+		n, err := p.downloadS3Object(ctx, client, sourceDir, key, target)
+		if err != nil {
+			return fmt.Errorf("download %s: %w", key, err)
 		}
+		count.Add(1)
+		size.Add(n)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Download failed", "error", err, "bucket", p.Bucket, "dir", sourceDir, "objects", count.Load())
+		return count.Load(), size.Load(), err
 	}
 
-	return nil
+	slog.Info("Download complete", "bucket", p.Bucket, "dir", sourceDir, "objects", count.Load(), "bytes", size.Load())
+
+	return count.Load(), size.Load(), nil
 }
 
-func (p *Plugin) createS3Client(ctx context.Context) *s3.Client {
-	optFns := []func(*config.LoadOptions) error{
-		config.WithRegion(p.Region),
+// sharedConfigOptions selects the configured profile and shared config files.
+func (p *Plugin) sharedConfigOptions() []func(*config.LoadOptions) error {
+	var optFns []func(*config.LoadOptions) error
+	if p.Profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(p.Profile))
+	}
+	if p.SharedConfigFile != "" {
+		optFns = append(optFns, config.WithSharedConfigFiles([]string{p.SharedConfigFile}))
+	}
+	if p.SharedCredentialsFile != "" {
+		optFns = append(optFns, config.WithSharedCredentialsFiles([]string{p.SharedCredentialsFile}))
+	}
+	return optFns
+}
+
+// createS3Client sets up the credentials and the S3 client. Its errors wrap
+// errMissingCredentials, errSTSDenied or errInvalidEndpoint where they apply.
+func (p *Plugin) createS3Client(ctx context.Context) (*s3.Client, error) {
+	session, err := p.roleSession()
+	if err != nil {
+		return nil, err
 	}
 
+	optFns := append([]func(*config.LoadOptions) error{
+		config.WithRegion(p.Region),
+	}, p.sharedConfigOptions()...)
+
 	if p.Key != "" && p.Secret != "" {
 		if p.SessionToken != "" {
 			slog.Info("Using static credentials with session token (temporary credentials)")
@@ -460,17 +1155,28 @@ func (p *Plugin) createS3Client(ctx context.Context) *s3.Client {
 		optFns = append(optFns, config.WithCredentialsProvider(
 			credentials.NewStaticCredentialsProvider(p.Key, p.Secret, p.SessionToken),
 		))
-	} else if p.IdToken != "" && p.AssumeRole != "" {
-		creds, err := assumeRoleWithWebIdentity(ctx, p.AssumeRole, p.AssumeRoleSessionName, p.IdToken, p.Region)
+	} else if (p.IdToken != "" || p.IdTokenFile != "") && p.AssumeRole != "" {
+		if p.IdToken != "" && p.IdTokenFile != "" {
+			return nil, fmt.Errorf("oidc_token_id and oidc_token_file are mutually exclusive")
+		}
+		var token stscreds.IdentityTokenRetriever = identityToken(p.IdToken)
+		if p.IdTokenFile != "" {
+			slog.Info("Using web identity token file", "file", p.IdTokenFile)
+			token = stscreds.IdentityTokenFile(p.IdTokenFile)
+		}
+		creds, err := assumeRoleWithWebIdentity(ctx, p.AssumeRole, p.Region, token, session)
 		if err != nil {
-			slog.Error("failed to assume role with web identity", "error", err)
-			os.Exit(1)
+			return nil, err
 		}
 		optFns = append(optFns, config.WithCredentialsProvider(creds))
 	} else if p.AssumeRole != "" {
-		optFns = append(optFns, config.WithCredentialsProvider(
-			assumeRole(ctx, p.AssumeRole, p.AssumeRoleSessionName, p.ExternalID, p.Region),
-		))
+		creds, err := assumeRole(ctx, p.AssumeRole, p.ExternalID, p.Region, session, p.sharedConfigOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		optFns = append(optFns, config.WithCredentialsProvider(creds))
+	} else if p.Profile != "" {
+		slog.Info("Using shared config profile", "profile", p.Profile)
 	} else {
 		// No explicit credentials provided, falling back to the default AWS SDK credential chain.
 		// The SDK will check: env vars -> shared credentials -> container credentials -> EC2 IMDS
@@ -488,14 +1194,16 @@ func (p *Plugin) createS3Client(ctx context.Context) *s3.Client {
 
 	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
 	if err != nil {
-		slog.Error("failed to load AWS config", "error", err)
-		os.Exit(1)
+		return nil, configError(fmt.Errorf("failed to load AWS config: %w", err))
 	}
 
 	s3Opts := []func(*s3.Options){}
 
 	if p.Endpoint != "" {
 		endpoint := normalizeEndpoint(p.Endpoint)
+		if err := validateEndpoint(endpoint); err != nil {
+			return nil, err
+		}
 		s3Opts = append(s3Opts, func(o *s3.Options) {
 			o.BaseEndpoint = aws.String(endpoint)
 			o.UsePathStyle = p.PathStyle
@@ -516,6 +1224,7 @@ func (p *Plugin) createS3Client(ctx context.Context) *s3.Client {
 
 		stsSvc := sts.NewFromConfig(cfg)
 		provider := stscreds.NewAssumeRoleProvider(stsSvc, p.UserRoleArn, func(o *stscreds.AssumeRoleOptions) {
+			session.apply(o)
 			if p.UserRoleExternalID != "" {
 				o.ExternalID = aws.String(p.UserRoleExternalID)
 			}
@@ -525,31 +1234,42 @@ func (p *Plugin) createS3Client(ctx context.Context) *s3.Client {
 		client = s3.NewFromConfig(cfg, s3Opts...)
 	}
 
-	return client
+	// resolve the credentials up front, so missing credentials and denied
+	// role assumptions fail before any transfer; dry runs work without them
+	if !p.DryRun {
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return nil, credentialsError(err)
+		}
+	}
+
+	return client, nil
+}
+
+// identityToken is an OIDC token passed inline. The credentials are renewed
+// with the same token until it expires.
+type identityToken string
+
+func (t identityToken) GetIdentityToken() ([]byte, error) {
+	return []byte(t), nil
 }
 
-func assumeRoleWithWebIdentity(ctx context.Context, roleArn, roleSessionName, idToken, region string) (aws.CredentialsProvider, error) {
+// assumeRoleWithWebIdentity returns credentials for roleArn that are
+// exchanged for the token again whenever they are about to expire.
+func assumeRoleWithWebIdentity(ctx context.Context, roleArn, region string, token stscreds.IdentityTokenRetriever, session *roleSession) (aws.CredentialsProvider, error) {
 	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+		return nil, configError(fmt.Errorf("failed to load AWS config: %w", err))
 	}
 	stsSvc := sts.NewFromConfig(cfg)
-	result, err := stsSvc.AssumeRoleWithWebIdentity(ctx, &sts.AssumeRoleWithWebIdentityInput{
-		RoleArn:          aws.String(roleArn),
-		RoleSessionName:  aws.String(roleSessionName),
-		WebIdentityToken: aws.String(idToken),
+	provider := stscreds.NewWebIdentityRoleProvider(stsSvc, roleArn, token, func(o *stscreds.WebIdentityRoleOptions) {
+		// session tags and source identity are claims of the token itself
+		o.RoleSessionName = session.name
+		o.Duration = session.duration
+		if session.policy != "" {
+			o.Policy = aws.String(session.policy)
+		}
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to assume role with web identity: %w", err)
-	}
-	if result.Credentials == nil {
-		return nil, fmt.Errorf("STS AssumeRoleWithWebIdentity returned nil credentials")
-	}
-	return credentials.NewStaticCredentialsProvider(
-		*result.Credentials.AccessKeyId,
-		*result.Credentials.SecretAccessKey,
-		*result.Credentials.SessionToken,
-	), nil
+	return aws.NewCredentialsCache(provider), nil
 }
 
 func validateStripPrefix(pattern string) error {
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/config"
 )
 
 func TestIsDir(t *testing.T) {
@@ -88,4 +97,235 @@ func TestIsDir(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestWantObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		key      string
+		expected bool
+	}{
+		{
+			name:     "no patterns",
+			key:      "artifacts/app/app.jar",
+			expected: true,
+		},
+		{
+			name:     "include matches",
+			include:  []string{"**/*.jar"},
+			key:      "artifacts/app/app.jar",
+			expected: true,
+		},
+		{
+			name:     "include does not match",
+			include:  []string{"**/*.jar"},
+			key:      "artifacts/app/app.war",
+			expected: false,
+		},
+		{
+			name:     "include is relative to source",
+			include:  []string{"app/*"},
+			key:      "artifacts/app/app.jar",
+			expected: true,
+		},
+		{
+			name:     "exclude wins over include",
+			include:  []string{"**/*.jar"},
+			exclude:  []string{"**/*-sources.jar"},
+			key:      "artifacts/app/app-sources.jar",
+			expected: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Plugin{Include: tc.include, Exclude: tc.exclude}
+			if got := p.wantObject("artifacts/", tc.key); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSharedConfigOptions(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	credentialsFile := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(configFile, []byte("[profile deploy]\nregion = eu-west-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentialsFile, []byte("[deploy]\naws_access_key_id = AKIDDEPLOY\naws_secret_access_key = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+
+	p := &Plugin{Profile: "deploy", SharedConfigFile: configFile, SharedCredentialsFile: credentialsFile}
+	cfg, err := config.LoadDefaultConfig(context.Background(), p.sharedConfigOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Region != "eu-west-1" {
+		t.Errorf("expected region from profile, got '%s'", cfg.Region)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKIDDEPLOY" {
+		t.Errorf("expected access key from profile, got '%s'", creds.AccessKeyID)
+	}
+
+	p = &Plugin{Profile: "missing", SharedConfigFile: configFile, SharedCredentialsFile: credentialsFile}
+	if _, err := config.LoadDefaultConfig(context.Background(), p.sharedConfigOptions()...); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+
+	if opts := (&Plugin{}).sharedConfigOptions(); len(opts) != 0 {
+		t.Errorf("expected no options without a profile, got %d", len(opts))
+	}
+}
+
+func TestDownloadS3ObjectSourceKey(t *testing.T) {
+	key := "cache/main/node_modules.tar.gz"
+	archive := writeTarGzip(t, &tar.Header{Name: "pkg/index.js", Mode: 0o644, Size: 3, Typeflag: tar.TypeReg})
+	server := httptest.NewServer(&fakeS3{objects: map[string][]byte{key: archive.Bytes()}})
+	defer server.Close()
+	client := newFakeS3Client(server)
+
+	// the object is written to target itself
+	dir := t.TempDir()
+	p := &Plugin{Bucket: "bucket", Target: filepath.Join(dir, "deps.tar.gz")}
+	if _, err := p.downloadS3Object(context.Background(), client, key, key, resolveSource(key, key, "")); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(p.Target); err != nil || stat.Size() != int64(archive.Len()) {
+		t.Errorf("expected object at target, got %v", err)
+	}
+
+	// archives are extracted into target
+	p = &Plugin{Bucket: "bucket", Target: filepath.Join(dir, "node_modules"), Extract: true}
+	if _, err := p.downloadS3Object(context.Background(), client, key, key, resolveSource(key, key, "")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(p.Target, "pkg", "index.js")); err != nil {
+		t.Errorf("expected archive extracted into target: %v", err)
+	}
+}
+
+func TestDownloadS3ObjectExtractCorrupted(t *testing.T) {
+	key := "cache/deps.tar.gz"
+	archive := writeTarGzip(t, &tar.Header{Name: "pkg/index.js", Mode: 0o644, Size: 3, Typeflag: tar.TypeReg})
+	server := httptest.NewServer(&fakeS3{
+		objects: map[string][]byte{key: archive.Bytes()},
+		etags:   map[string]string{key: "0123456789abcdef0123456789abcdef"},
+	})
+	defer server.Close()
+
+	dir := t.TempDir()
+	p := &Plugin{Bucket: "bucket", Target: dir, Extract: true}
+	_, err := p.downloadS3Object(context.Background(), newFakeS3Client(server), "cache/", key, resolveSource("cache/", key, ""))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	// nothing of the unverified archive is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected entry left in target: %s", entry.Name())
+	}
+}
+
+func TestValidatePartSize(t *testing.T) {
+	tests := map[int64]bool{
+		0:  true,
+		5:  true,
+		16: true,
+		4:  false,
+		-1: false,
+	}
+	for partSize, valid := range tests {
+		err := validatePartSize(partSize)
+		if valid && err != nil {
+			t.Errorf("%d: unexpected error: %v", partSize, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%d: expected error", partSize)
+		}
+	}
+}
+
+func TestDownloadS3ObjectIncomplete(t *testing.T) {
+	// the connection is closed after half of the announced body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, strings.Repeat("0", 32)))
+		w.Write([]byte(strings.Repeat("x", 50)))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	p := &Plugin{Bucket: "bucket", Target: dir}
+	_, err := p.downloadS3Object(context.Background(), newFakeS3Client(server), "cache/", "cache/data.bin", "data.bin")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF for a truncated body, got %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected file left in target: %s", entry.Name())
+	}
+}
+
+func TestDownloadS3ObjectsPaginated(t *testing.T) {
+	// more objects than fit on a single ListObjectsV2 page
+	fake := &fakeS3{objects: map[string][]byte{}}
+	var total int64
+	for i := range 2*fakeListPage + 10 {
+		body := []byte(fmt.Sprintf("object %d", i))
+		fake.objects[fmt.Sprintf("cache/%04d.txt", i)] = body
+		total += int64(len(body))
+	}
+	fake.objects["other/skipped.txt"] = []byte("not below the source")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir := t.TempDir()
+	p := &Plugin{Bucket: "bucket", Target: dir, Parallelism: 8}
+	objects, size, err := p.downloadS3Objects(context.Background(), newFakeS3Client(server), "cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.pages != 3 {
+		t.Errorf("expected 3 list pages, got %d", fake.pages)
+	}
+	if objects != 2*fakeListPage+10 || size != total {
+		t.Errorf("expected %d objects and %d bytes, got %d and %d", 2*fakeListPage+10, total, objects, size)
+	}
+
+	for key, body := range fake.objects {
+		name, ok := strings.CutPrefix(key, "cache/")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else if string(data) != string(body) {
+			t.Errorf("%s: expected %q, got %q", key, body, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "skipped.txt")); err == nil {
+		t.Error("expected objects outside the source to be skipped")
+	}
+}
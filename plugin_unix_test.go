@@ -129,3 +129,35 @@ func TestResolveSource(t *testing.T) {
 	}
 }
 
+func TestContainedPath(t *testing.T) {
+	tests := []struct {
+		root        string
+		rel         string
+		expected    string
+		expectError bool
+	}{
+		{root: "out", rel: "a/b.txt", expected: "out/a/b.txt"},
+		{root: "", rel: "a/b.txt", expected: "a/b.txt"},
+		{root: "out", rel: "a/../b.txt", expected: "out/b.txt"},
+		{root: "out", rel: "../b.txt", expectError: true},
+		{root: "out", rel: "a/../../b.txt", expectError: true},
+		{root: "out", rel: "/etc/passwd", expectError: true},
+		{root: "out", rel: "..", expectError: true},
+		{root: "out", rel: "", expectError: true},
+	}
+
+	for _, tc := range tests {
+		got, err := containedPath(tc.root, tc.rel)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", tc.rel, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.rel, err)
+		} else if got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.rel, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// Limits STS applies to the duration of a role session.
+const (
+	defaultRoleDuration = time.Hour
+	minRoleDuration     = 15 * time.Minute
+	maxRoleDuration     = 12 * time.Hour
+)
+
+// roleSession holds the session options applied to both role assumptions,
+// AssumeRole and UserRoleArn.
+type roleSession struct {
+	name              string
+	duration          time.Duration
+	tags              []ststypes.Tag
+	transitiveTagKeys []string
+	sourceIdentity    string
+	policy            string
+}
+
+// roleSession validates the role session options.
+func (p *Plugin) roleSession() (*roleSession, error) {
+	s := &roleSession{
+		name:              p.AssumeRoleSessionName,
+		duration:          p.AssumeRoleDuration,
+		transitiveTagKeys: p.AssumeRoleTransitiveTagKeys,
+		sourceIdentity:    p.AssumeRoleSourceIdentity,
+		policy:            p.AssumeRolePolicy,
+	}
+
+	if s.duration == 0 {
+		s.duration = defaultRoleDuration
+	}
+	if s.duration < minRoleDuration || s.duration > maxRoleDuration {
+		return nil, fmt.Errorf("assume_role_duration must be between %s and %s, got %s", minRoleDuration, maxRoleDuration, s.duration)
+	}
+
+	if p.AssumeRoleSessionTags != "" {
+		pairs := map[string]string{}
+		if err := json.Unmarshal([]byte(p.AssumeRoleSessionTags), &pairs); err != nil {
+			return nil, fmt.Errorf("assume_role_session_tags must be a JSON object of strings: %w", err)
+		}
+		for _, key := range slices.Sorted(maps.Keys(pairs)) {
+			s.tags = append(s.tags, ststypes.Tag{Key: aws.String(key), Value: aws.String(pairs[key])})
+		}
+	}
+
+	for _, key := range s.transitiveTagKeys {
+		if !slices.ContainsFunc(s.tags, func(tag ststypes.Tag) bool { return aws.ToString(tag.Key) == key }) {
+			return nil, fmt.Errorf("transitive tag key '%s' is not one of the assume_role_session_tags", key)
+		}
+	}
+
+	if s.policy != "" && !json.Valid([]byte(s.policy)) {
+		return nil, fmt.Errorf("assume_role_policy must be a JSON policy document")
+	}
+
+	return s, nil
+}
+
+// apply sets the session options on an AssumeRole request.
+func (s *roleSession) apply(o *stscreds.AssumeRoleOptions) {
+	o.RoleSessionName = s.name
+	o.Duration = s.duration
+	o.Tags = s.tags
+	o.TransitiveTagKeys = s.transitiveTagKeys
+	if s.sourceIdentity != "" {
+		o.SourceIdentity = aws.String(s.sourceIdentity)
+	}
+	if s.policy != "" {
+		o.Policy = aws.String(s.policy)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+func TestRoleSession(t *testing.T) {
+	tests := []struct {
+		name        string
+		plugin      Plugin
+		expectError bool
+	}{
+		{name: "defaults", plugin: Plugin{}},
+		{name: "duration", plugin: Plugin{AssumeRoleDuration: 6 * time.Hour}},
+		{name: "duration too short", plugin: Plugin{AssumeRoleDuration: time.Minute}, expectError: true},
+		{name: "duration too long", plugin: Plugin{AssumeRoleDuration: 13 * time.Hour}, expectError: true},
+		{name: "tags", plugin: Plugin{AssumeRoleSessionTags: `{"team": "web"}`, AssumeRoleTransitiveTagKeys: []string{"team"}}},
+		{name: "invalid tags", plugin: Plugin{AssumeRoleSessionTags: `team=web`}, expectError: true},
+		{name: "unknown transitive key", plugin: Plugin{AssumeRoleSessionTags: `{"team": "web"}`, AssumeRoleTransitiveTagKeys: []string{"owner"}}, expectError: true},
+		{name: "policy", plugin: Plugin{AssumeRolePolicy: `{"Version": "2012-10-17", "Statement": []}`}},
+		{name: "invalid policy", plugin: Plugin{AssumeRolePolicy: `{"Version":`}, expectError: true},
+	}
+
+	for _, tc := range tests {
+		_, err := tc.plugin.roleSession()
+		if tc.expectError && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRoleSessionApply(t *testing.T) {
+	p := &Plugin{
+		AssumeRoleSessionName:       "drone-s3",
+		AssumeRoleSessionTags:       `{"team": "web", "build": "42"}`,
+		AssumeRoleTransitiveTagKeys: []string{"team"},
+		AssumeRoleSourceIdentity:    "octocat",
+	}
+	session, err := p.roleSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var o stscreds.AssumeRoleOptions
+	session.apply(&o)
+	if o.RoleSessionName != "drone-s3" || o.Duration != time.Hour {
+		t.Errorf("unexpected session name or duration: %s %s", o.RoleSessionName, o.Duration)
+	}
+	if len(o.Tags) != 2 || aws.ToString(o.Tags[0].Key) != "build" || aws.ToString(o.Tags[1].Value) != "web" {
+		t.Errorf("expected tags sorted by key, got %v", o.Tags)
+	}
+	if aws.ToString(o.SourceIdentity) != "octocat" {
+		t.Errorf("expected source identity octocat, got %s", aws.ToString(o.SourceIdentity))
+	}
+	if o.Policy != nil {
+		t.Errorf("expected no policy, got %s", aws.ToString(o.Policy))
+	}
+}
+
+func TestCreateS3ClientRoleSession(t *testing.T) {
+	isolateAWSEnv(t)
+
+	var mu sync.Mutex
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		requests = append(requests, r.PostForm)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2030-01-01T00:00:00Z</Expiration></Credentials><AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/deploy/drone-s3</Arn><AssumedRoleId>AROAEXAMPLE:drone-s3</AssumedRoleId></AssumedRoleUser></AssumeRoleResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></AssumeRoleResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	p := &Plugin{
+		Region:                      "us-east-1",
+		AssumeRole:                  "arn:aws:iam::123456789012:role/deploy",
+		AssumeRoleSessionName:       "drone-s3",
+		UserRoleArn:                 "arn:aws:iam::210987654321:role/upload",
+		AssumeRoleDuration:          30 * time.Minute,
+		AssumeRoleSessionTags:       `{"team": "web"}`,
+		AssumeRoleTransitiveTagKeys: []string{"team"},
+		AssumeRoleSourceIdentity:    "octocat",
+		AssumeRolePolicy:            `{"Version":"2012-10-17","Statement":[]}`,
+	}
+	if _, err := p.createS3Client(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected AssumeRole for both roles, got %d requests", len(requests))
+	}
+	for i, role := range []string{p.AssumeRole, p.UserRoleArn} {
+		form := requests[i]
+		expected := map[string]string{
+			"Action":                     "AssumeRole",
+			"RoleArn":                    role,
+			"RoleSessionName":            "drone-s3",
+			"DurationSeconds":            "1800",
+			"Tags.member.1.Key":          "team",
+			"Tags.member.1.Value":        "web",
+			"TransitiveTagKeys.member.1": "team",
+			"SourceIdentity":             "octocat",
+			"Policy":                     p.AssumeRolePolicy,
+		}
+		for key, value := range expected {
+			if got := form.Get(key); got != value {
+				t.Errorf("request %d: expected %s=%s, got %s", i+1, key, value, got)
+			}
+		}
+	}
+}
+
+// fakeSTS answers AssumeRole and AssumeRoleWithWebIdentity requests and
+// records their form values.
+type fakeSTS struct {
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+func (f *fakeSTS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, r.PostForm)
+	n := len(f.requests)
+	f.mu.Unlock()
+
+	action := r.PostForm.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<%[1]sResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><%[1]sResult><Credentials><AccessKeyId>ASIA%[2]d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2030-01-01T00:00:00Z</Expiration></Credentials><AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/deploy/drone-s3</Arn><AssumedRoleId>AROAEXAMPLE:drone-s3</AssumedRoleId></AssumedRoleUser></%[1]sResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></%[1]sResponse>`, action, n)
+}
+
+func TestAssumeRoleWithWebIdentityTokenFile(t *testing.T) {
+	isolateAWSEnv(t)
+	sts := &fakeSTS{}
+	server := httptest.NewServer(sts)
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("first-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := (&Plugin{AssumeRoleSessionName: "drone-s3", AssumeRoleDuration: 2 * time.Hour}).roleSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := assumeRoleWithWebIdentity(context.Background(), "arn:aws:iam::123456789012:role/deploy", "us-east-1", stscreds.IdentityTokenFile(tokenFile), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Retrieve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotated token is read again when the credentials are refreshed
+	if err := os.WriteFile(tokenFile, []byte("second-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider.(*aws.CredentialsCache).Invalidate()
+	creds, err := provider.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIA2" {
+		t.Errorf("expected refreshed credentials, got %s", creds.AccessKeyID)
+	}
+
+	if len(sts.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(sts.requests))
+	}
+	for i, token := range []string{"first-token", "second-token"} {
+		form := sts.requests[i]
+		if form.Get("Action") != "AssumeRoleWithWebIdentity" || form.Get("WebIdentityToken") != token {
+			t.Errorf("request %d: expected web identity token %s, got %v", i+1, token, form)
+		}
+		if form.Get("DurationSeconds") != "7200" || form.Get("RoleSessionName") != "drone-s3" {
+			t.Errorf("request %d: expected session options, got %v", i+1, form)
+		}
+	}
+}
+
+func TestCreateS3ClientWebIdentityChain(t *testing.T) {
+	isolateAWSEnv(t)
+	sts := &fakeSTS{}
+	server := httptest.NewServer(sts)
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("oidc-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Plugin{
+		Region:                "us-east-1",
+		AssumeRole:            "arn:aws:iam::123456789012:role/deploy",
+		AssumeRoleSessionName: "drone-s3",
+		IdTokenFile:           tokenFile,
+		UserRoleArn:           "arn:aws:iam::210987654321:role/upload",
+	}
+	if _, err := p.createS3Client(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sts.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(sts.requests))
+	}
+	if sts.requests[0].Get("Action") != "AssumeRoleWithWebIdentity" || sts.requests[0].Get("RoleArn") != p.AssumeRole {
+		t.Errorf("expected web identity role first, got %v", sts.requests[0])
+	}
+	if sts.requests[1].Get("Action") != "AssumeRole" || sts.requests[1].Get("RoleArn") != p.UserRoleArn {
+		t.Errorf("expected user role on top, got %v", sts.requests[1])
+	}
+
+	p.IdToken = "inline-token"
+	if _, err := p.createS3Client(context.Background()); err == nil {
+		t.Error("expected error when both token options are set")
+	}
+}
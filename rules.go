@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mattn/go-zglob"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported values for Rules.Match.
+const (
+	matchFirst = "first"
+	matchLast  = "last"
+)
+
+// Rules is an ordered list of per-file upload settings, loaded from a YAML
+// or JSON file.
+type Rules struct {
+	// first (default): a setting is taken from the first matching rule that sets it
+	// last: a setting is taken from the last matching rule that sets it
+	Match string `yaml:"match"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule applies its settings to every file matching either Glob or Regex.
+type Rule struct {
+	Glob  string `yaml:"glob"`
+	Regex string `yaml:"regex"`
+
+	ContentType     string            `yaml:"content_type"`
+	ContentEncoding string            `yaml:"content_encoding"`
+	CacheControl    string            `yaml:"cache_control"`
+	Metadata        map[string]string `yaml:"metadata"`
+	Tags            map[string]string `yaml:"tags"`
+	ACL             string            `yaml:"acl"`
+	StorageClass    string            `yaml:"storage_class"`
+	Encryption      string            `yaml:"encryption"`
+	KMSKeyID        string            `yaml:"kms_key_id"`
+
+	re *regexp.Regexp
+}
+
+func loadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	rules := &Rules{}
+	// JSON is valid YAML, so one decoder reads both formats
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse rules file '%s': %w", path, err)
+	}
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("invalid rules file '%s': %w", path, err)
+	}
+	return rules, nil
+}
+
+func (r *Rules) validate() error {
+	switch r.Match {
+	case "":
+		r.Match = matchFirst
+	case matchFirst, matchLast:
+	default:
+		return fmt.Errorf("match must be '%s' or '%s', got '%s'", matchFirst, matchLast, r.Match)
+	}
+
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if (rule.Glob == "") == (rule.Regex == "") {
+			return fmt.Errorf("rule %d: exactly one of glob or regex is required", i+1)
+		}
+		if rule.Glob != "" {
+			if _, err := zglob.Match(rule.Glob, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid glob '%s': %w", i+1, rule.Glob, err)
+			}
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return fmt.Errorf("rule %d: invalid regex '%s': %w", i+1, rule.Regex, err)
+			}
+			rule.re = re
+		}
+
+		if rule.Encryption != "" && rule.Encryption != string(s3types.ServerSideEncryptionAes256) && !isKMSEncryption(rule.Encryption) {
+			return fmt.Errorf("rule %d: unsupported encryption '%s'", i+1, rule.Encryption)
+		}
+		if rule.KMSKeyID != "" {
+			if !isKMSEncryption(rule.Encryption) {
+				return fmt.Errorf("rule %d: kms_key_id requires encryption 'aws:kms' or 'aws:kms:dsse'", i+1)
+			}
+			if !kmsKeyPattern.MatchString(rule.KMSKeyID) {
+				return fmt.Errorf("rule %d: kms_key_id '%s' is not a KMS key ID, key ARN, alias or alias ARN", i+1, rule.KMSKeyID)
+			}
+		}
+
+		for _, pairs := range []map[string]string{rule.Metadata, rule.Tags} {
+			for key, value := range pairs {
+				if key == "" {
+					return fmt.Errorf("rule %d: metadata and tags cannot contain an empty key", i+1)
+				}
+				if err := validateTemplate(value, true); err != nil {
+					return fmt.Errorf("rule %d: %w", i+1, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// usesEncryption reports whether any rule sets server-side encryption.
+func (r *Rules) usesEncryption() bool {
+	return slices.ContainsFunc(r.Rules, func(rule Rule) bool { return rule.Encryption != "" })
+}
+
+// expand fills in the build placeholders of all metadata and tag values.
+func (r *Rules) expand(values map[string]string) {
+	for _, rule := range r.Rules {
+		for _, pairs := range []map[string]string{rule.Metadata, rule.Tags} {
+			for key, value := range pairs {
+				pairs[key] = expandTemplate(value, values)
+			}
+		}
+	}
+}
+
+func (rule *Rule) matches(path string) bool {
+	if rule.re != nil {
+		return rule.re.MatchString(path)
+	}
+	ok, err := zglob.Match(rule.Glob, path)
+	return err == nil && ok
+}
+
+// resolve returns the settings for the file at path. Every setting, and
+// every metadata and tag key, comes from the first or last matching rule
+// that sets it, depending on Match.
+func (r *Rules) resolve(path string) Rule {
+	path = filepath.ToSlash(path)
+
+	var resolved Rule
+	set := func(dst *string, value string) {
+		if *dst == "" {
+			*dst = value
+		}
+	}
+	merge := func(dst *map[string]string, pairs map[string]string) {
+		for key, value := range pairs {
+			if *dst == nil {
+				*dst = map[string]string{}
+			}
+			if _, ok := (*dst)[key]; !ok {
+				(*dst)[key] = expandTemplate(value, fileValues(path))
+			}
+		}
+	}
+
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if r.Match == matchLast {
+			rule = &r.Rules[len(r.Rules)-1-i]
+		}
+		if !rule.matches(path) {
+			continue
+		}
+		set(&resolved.ContentType, rule.ContentType)
+		set(&resolved.ContentEncoding, rule.ContentEncoding)
+		set(&resolved.CacheControl, rule.CacheControl)
+		set(&resolved.ACL, rule.ACL)
+		set(&resolved.StorageClass, rule.StorageClass)
+		// a KMS key only makes sense together with the encryption that named it
+		if resolved.Encryption == "" && rule.Encryption != "" {
+			resolved.Encryption = rule.Encryption
+			resolved.KMSKeyID = rule.KMSKeyID
+		}
+		merge(&resolved.Metadata, rule.Metadata)
+		merge(&resolved.Tags, rule.Tags)
+	}
+	return resolved
+}
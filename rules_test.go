@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeRules(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		content     string
+		expectError bool
+	}{
+		{
+			name: "yaml",
+			file: "rules.yml",
+			content: `
+rules:
+  - glob: "**/*.html"
+    cache_control: no-cache
+  - regex: '\.js$'
+    metadata:
+      page: "{{ file.base }}"
+`,
+		},
+		{
+			name:    "json",
+			file:    "rules.json",
+			content: `{"match": "last", "rules": [{"glob": "*.css", "content_type": "text/css"}]}`,
+		},
+		{
+			name:        "unknown field",
+			file:        "rules.yml",
+			content:     "rules:\n  - glob: '*'\n    cache: no-cache\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid match",
+			file:        "rules.yml",
+			content:     "match: any\nrules: []\n",
+			expectError: true,
+		},
+		{
+			name:        "glob and regex",
+			file:        "rules.yml",
+			content:     "rules:\n  - glob: '*'\n    regex: '.*'\n",
+			expectError: true,
+		},
+		{
+			name:        "no pattern",
+			file:        "rules.yml",
+			content:     "rules:\n  - acl: private\n",
+			expectError: true,
+		},
+		{
+			name:        "invalid regex",
+			file:        "rules.yml",
+			content:     "rules:\n  - regex: '('\n",
+			expectError: true,
+		},
+		{
+			name:        "kms key without kms encryption",
+			file:        "rules.yml",
+			content:     "rules:\n  - glob: '*'\n    kms_key_id: alias/site\n",
+			expectError: true,
+		},
+		{
+			name:        "unsupported encryption",
+			file:        "rules.yml",
+			content:     "rules:\n  - glob: '*'\n    encryption: rot13\n",
+			expectError: true,
+		},
+		{
+			name:        "unknown placeholder",
+			file:        "rules.yml",
+			content:     "rules:\n  - glob: '*'\n    tags:\n      owner: '{{ user }}'\n",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		_, err := loadRules(writeRules(t, tc.file, tc.content))
+		if tc.expectError && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRulesResolve(t *testing.T) {
+	content := `
+rules:
+  - glob: "dist/*.html"
+    cache_control: no-cache
+    metadata:
+      page: "{{ file.base }}"
+  - regex: '\.html$'
+    content_type: text/html; charset=utf-8
+    cache_control: max-age=60
+    metadata:
+      page: other
+      kind: html
+  - glob: "**/*"
+    storage_class: STANDARD_IA
+    encryption: aws:kms
+    kms_key_id: alias/site
+`
+	tests := []struct {
+		match    string
+		path     string
+		expected Rule
+	}{
+		{
+			match: matchFirst,
+			path:  "dist/index.html",
+			expected: Rule{
+				ContentType:  "text/html; charset=utf-8",
+				CacheControl: "no-cache",
+				StorageClass: "STANDARD_IA",
+				Encryption:   "aws:kms",
+				KMSKeyID:     "alias/site",
+				Metadata:     map[string]string{"page": "index", "kind": "html"},
+			},
+		},
+		{
+			match: matchLast,
+			path:  "dist/index.html",
+			expected: Rule{
+				ContentType:  "text/html; charset=utf-8",
+				CacheControl: "max-age=60",
+				StorageClass: "STANDARD_IA",
+				Encryption:   "aws:kms",
+				KMSKeyID:     "alias/site",
+				Metadata:     map[string]string{"page": "other", "kind": "html"},
+			},
+		},
+		{
+			match: matchFirst,
+			path:  "dist/app.js",
+			expected: Rule{
+				StorageClass: "STANDARD_IA",
+				Encryption:   "aws:kms",
+				KMSKeyID:     "alias/site",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		rules, err := loadRules(writeRules(t, "rules.yml", "match: "+tc.match+"\n"+content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := rules.resolve(tc.path)
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s %s: expected %+v, got %+v", tc.match, tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestRulesExpand(t *testing.T) {
+	rules, err := loadRules(writeRules(t, "rules.yml", "rules:\n  - glob: '*'\n    tags:\n      release: '{{ build.tag }}'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.expand(map[string]string{"build.tag": "v1.2.0"})
+	if got := rules.resolve("app.js").Tags["release"]; got != "v1.2.0" {
+		t.Errorf("expected expanded tag v1.2.0, got %s", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 type StringMapFlag struct {
@@ -25,3 +26,34 @@ func (s *StringMapFlag) Set(value string) error {
 
 	return nil
 }
+
+// KeyValueMapFlag maps file patterns to key/value pairs, such as the user
+// metadata or tags set on matching objects. A plain JSON object of pairs
+// applies to every file.
+type KeyValueMapFlag struct {
+	parts map[string]map[string]string
+}
+
+func (s *KeyValueMapFlag) String() string {
+	return ""
+}
+
+func (s *KeyValueMapFlag) Get() map[string]map[string]string {
+	return s.parts
+}
+
+func (s *KeyValueMapFlag) Set(value string) error {
+	s.parts = map[string]map[string]string{}
+
+	if err := json.Unmarshal([]byte(value), &s.parts); err == nil {
+		return nil
+	}
+
+	pairs := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &pairs); err != nil {
+		return fmt.Errorf("value must be a JSON object: %w", err)
+	}
+	s.parts = map[string]map[string]string{".*": pairs}
+
+	return nil
+}
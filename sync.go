@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// md5MetadataKey is the user metadata key holding the MD5 of the uploaded
+// file, used when the ETag of an object is not a plain MD5 digest (multipart
+// uploads, SSE-KMS).
+const md5MetadataKey = "md5"
+
+// remoteObject is the state of an existing object under the target prefix.
+type remoteObject struct {
+	size int64
+	etag string
+}
+
+// listObjects returns every object below prefix, keyed by object key.
+func listObjects(ctx context.Context, client *s3.Client, bucket, prefix string) (map[string]remoteObject, error) {
+	objects := map[string]remoteObject{}
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Contents {
+			objects[aws.ToString(item.Key)] = remoteObject{
+				size: aws.ToInt64(item.Size),
+				etag: strings.Trim(aws.ToString(item.ETag), `"`),
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// isMD5ETag reports whether the ETag is the hex MD5 digest of the object,
+// which is only the case for single part uploads without SSE-KMS.
+func isMD5ETag(etag string) bool {
+	if len(etag) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+// plainETag reports whether etag is known to be the MD5 of the object
+// content. Objects encrypted with SSE-KMS or SSE-C carry opaque ETags.
+func plainETag(etag string, sse s3types.ServerSideEncryption, sseCustomerAlgorithm *string) bool {
+	if sseCustomerAlgorithm != nil {
+		return false
+	}
+	if sse != "" && sse != s3types.ServerSideEncryptionAes256 {
+		return false
+	}
+	return isMD5ETag(etag)
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unchanged reports whether the remote object already holds the content of
+// the local file. The MD5 of the file, or its MAC with client-side encryption,
+// is recorded on u so a following upload can store it in the object metadata.
+func (p *Plugin) unchanged(ctx context.Context, client *s3.Client, u *upload) (bool, error) {
+	stat, err := os.Stat(u.match)
+	if err != nil {
+		return false, err
+	}
+
+	if p.cse != nil {
+		return p.unchangedSealed(ctx, client, u, stat.Size())
+	}
+
+	u.md5, err = fileMD5(u.match)
+	if err != nil {
+		slog.Error("Problem hashing file", "error", err, "file", u.match)
+		return false, err
+	}
+
+	if u.remote == nil {
+		return false, nil
+	}
+	// the size of compressed objects is only known after compressing them, so
+	// they are compared by their stored MD5 and content encoding alone
+	if u.compression == "" && u.remote.size != stat.Size() {
+		return false, nil
+	}
+	// ETags of encrypted objects are opaque even when they look like an MD5
+	if isMD5ETag(u.remote.etag) && p.sseCustomerKey == "" && u.compression == "" && !isKMSEncryption(u.encryption) {
+		return strings.EqualFold(u.remote.etag, u.md5), nil
+	}
+
+	head, err := p.headObject(ctx, client, u.target)
+	if err != nil {
+		return false, err
+	}
+	if aws.ToString(head.ContentEncoding) != u.contentEncoding && u.compression != "" {
+		return false, nil
+	}
+	return strings.EqualFold(head.Metadata[md5MetadataKey], u.md5), nil
+}
+
+// unchangedSealed compares a client-side encrypted object by the MAC of the
+// local file under the key the object was sealed with, so objects uploaded
+// with an earlier salt of the same passphrase still match.
+func (p *Plugin) unchangedSealed(ctx context.Context, client *s3.Client, u *upload, size int64) (bool, error) {
+	var err error
+	u.mac, err = contentMAC(p.cse.kek, u.match)
+	if err != nil {
+		slog.Error("Problem hashing file", "error", err, "file", u.match)
+		return false, err
+	}
+
+	if u.remote == nil || u.remote.size != sealedSize(size) {
+		return false, nil
+	}
+
+	head, err := p.headObject(ctx, client, u.target)
+	if err != nil {
+		return false, err
+	}
+	remoteMAC := head.Metadata[metaCSEMAC]
+	if remoteMAC == "" {
+		return false, nil
+	}
+	// objects sealed with another kind of key are uploaded again
+	kek, err := p.cse.objectKey(head.Metadata)
+	if err != nil {
+		return false, nil
+	}
+	mac := u.mac
+	if !bytes.Equal(kek, p.cse.kek) {
+		mac, err = contentMAC(kek, u.match)
+		if err != nil {
+			slog.Error("Problem hashing file", "error", err, "file", u.match)
+			return false, err
+		}
+	}
+	return hmac.Equal([]byte(mac), []byte(remoteMAC)), nil
+}
+
+func (p *Plugin) headObject(ctx context.Context, client *s3.Client, key string) (*s3.HeadObjectOutput, error) {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(key),
+	}
+	headObjectInput.SSECustomerAlgorithm, headObjectInput.SSECustomerKey, headObjectInput.SSECustomerKeyMD5 = p.sseCustomerHeaders()
+
+	head, err := client.HeadObject(ctx, headObjectInput)
+	if err != nil {
+		slog.Error("Cannot get S3 object metadata", "error", err, "bucket", p.Bucket, "key", key)
+		return nil, err
+	}
+	return head, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestIsMD5ETag(t *testing.T) {
+	tests := []struct {
+		etag     string
+		expected bool
+	}{
+		{etag: "d41d8cd98f00b204e9800998ecf8427e", expected: true},
+		{etag: "D41D8CD98F00B204E9800998ECF8427E", expected: true},
+		{etag: "d41d8cd98f00b204e9800998ecf8427e-3", expected: false},
+		{etag: "not-a-digest-not-a-digest-000000", expected: false},
+		{etag: "", expected: false},
+	}
+
+	for _, tc := range tests {
+		if got := isMD5ETag(tc.etag); got != tc.expected {
+			t.Errorf("isMD5ETag(%q): expected %v, got %v", tc.etag, tc.expected, got)
+		}
+	}
+}
+
+func TestFileMD5(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("hello world\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	got, err := fileMD5(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "6f5902ac237024bdd0c176cb93063dc4"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestPlainETag(t *testing.T) {
+	const etag = "d41d8cd98f00b204e9800998ecf8427e"
+	algorithm := "AES256"
+
+	tests := []struct {
+		name     string
+		sse      s3types.ServerSideEncryption
+		ssec     *string
+		expected bool
+	}{
+		{name: "unencrypted", expected: true},
+		{name: "sse-s3", sse: s3types.ServerSideEncryptionAes256, expected: true},
+		{name: "sse-kms", sse: s3types.ServerSideEncryptionAwsKms, expected: false},
+		{name: "sse-c", sse: s3types.ServerSideEncryptionAes256, ssec: &algorithm, expected: false},
+	}
+
+	for _, tc := range tests {
+		if got := plainETag(etag, tc.sse, tc.ssec); got != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestUnchangedClientEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	content := []byte("hello world\n")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	// the object was uploaded by an earlier run, with another salt
+	earlier, err := newClientEncryption("secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := newClientEncryption("secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, envelope, err := earlier.seal(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := contentMAC(earlier.kek, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withMAC := maps.Clone(envelope)
+	withMAC[metaCSEMAC] = mac
+
+	size := sealedSize(int64(len(content)))
+	fake := &fakeS3{
+		objects: map[string][]byte{
+			"site/hello.txt": make([]byte, size),
+			"site/old.txt":   make([]byte, size),
+		},
+		metadata: map[string]map[string]string{
+			"site/hello.txt": withMAC,
+			"site/old.txt":   envelope,
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := newFakeS3Client(server)
+	p := &Plugin{Bucket: "bucket", cse: current}
+
+	u := upload{match: path, target: "site/hello.txt", remote: &remoteObject{size: size}}
+	same, err := p.unchanged(context.Background(), client, &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same {
+		t.Error("expected object with matching MAC to be unchanged")
+	}
+	if u.md5 != "" {
+		t.Errorf("expected no MD5 of the plaintext, got %s", u.md5)
+	}
+	if u.mac == "" || u.mac == mac {
+		t.Errorf("expected MAC under the key of this run, got '%s'", u.mac)
+	}
+
+	// objects without a MAC are uploaded again
+	u = upload{match: path, target: "site/old.txt", remote: &remoteObject{size: size}}
+	if same, err := p.unchanged(context.Background(), client, &u); err != nil || same {
+		t.Errorf("expected object without MAC to change, got %v %v", same, err)
+	}
+
+	if err := os.WriteFile(path, []byte("hello there\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u = upload{match: path, target: "site/hello.txt", remote: &remoteObject{size: size}}
+	if same, err := p.unchanged(context.Background(), client, &u); err != nil || same {
+		t.Errorf("expected modified file to change, got %v %v", same, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build holds the pipeline metadata available to target templates.
+type Build struct {
+	Number string
+	Link   string
+	Branch string
+	Tag    string
+	Commit string
+	Repo   string
+}
+
+// placeholderPattern matches a template placeholder like {{ build.tag }}.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([a-z_.]+)\s*\}\}`)
+
+var buildPlaceholders = map[string]bool{
+	"build.number": true,
+	"build.link":   true,
+	"build.branch": true,
+	"build.tag":    true,
+	"commit.sha":   true,
+	"commit.short": true,
+	"repo.name":    true,
+	"date":         true,
+	"time":         true,
+	"timestamp":    true,
+}
+
+var filePlaceholders = map[string]bool{
+	"file.name": true,
+	"file.base": true,
+	"file.ext":  true,
+	"file.dir":  true,
+}
+
+// validateTemplate fails on unknown placeholders, and on per-file
+// placeholders when perFile is false.
+func validateTemplate(s string, perFile bool) error {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+		name := m[1]
+		if buildPlaceholders[name] || (perFile && filePlaceholders[name]) {
+			continue
+		}
+		if filePlaceholders[name] {
+			return fmt.Errorf("placeholder '%s' is not supported in '%s'", m[0], s)
+		}
+		return fmt.Errorf("unknown placeholder '%s' in '%s'", m[0], s)
+	}
+	return nil
+}
+
+// namesFile reports whether s contains a placeholder naming the file itself,
+// which makes s the whole key of the file rather than a prefix.
+func namesFile(s string) bool {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+		if m[1] == "file.name" || m[1] == "file.base" {
+			return true
+		}
+	}
+	return false
+}
+
+// expandTemplate replaces the placeholders found in values and leaves all
+// other placeholders untouched.
+func expandTemplate(s string, values map[string]string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return placeholderPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholderPattern.FindStringSubmatch(m)[1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// templatePrefix returns the literal part of s before its first placeholder.
+func templatePrefix(s string) string {
+	if loc := placeholderPattern.FindStringIndex(s); loc != nil {
+		return s[:loc[0]]
+	}
+	return s
+}
+
+func buildValues(b Build, now time.Time) map[string]string {
+	short := b.Commit
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	return map[string]string{
+		"build.number": b.Number,
+		"build.link":   b.Link,
+		"build.branch": b.Branch,
+		"build.tag":    b.Tag,
+		"commit.sha":   b.Commit,
+		"commit.short": short,
+		"repo.name":    b.Repo,
+		"date":         now.Format("2006-01-02"),
+		"time":         now.Format("150405"),
+		"timestamp":    strconv.FormatInt(now.Unix(), 10),
+	}
+}
+
+func fileValues(path string) map[string]string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	return map[string]string{
+		"file.name": name,
+		"file.base": strings.TrimSuffix(name, ext),
+		"file.ext":  strings.TrimPrefix(ext, "."),
+		"file.dir":  filepath.Base(filepath.Dir(path)),
+	}
+}
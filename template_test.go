@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+	build := buildValues(Build{
+		Number: "42",
+		Branch: "main",
+		Tag:    "v1.2.0",
+		Commit: "0123456789abcdef",
+	}, now)
+
+	tests := []struct {
+		template string
+		values   map[string]string
+		expected string
+	}{
+		{
+			template: "releases/{{ build.tag }}/{{commit.short}}",
+			values:   build,
+			expected: "releases/v1.2.0/01234567",
+		},
+		{
+			template: "builds/{{ build.branch }}/{{ build.number }}/{{ date }}-{{ time }}",
+			values:   build,
+			expected: "builds/main/42/2024-03-09-140507",
+		},
+		{
+			template: "plain/prefix",
+			values:   build,
+			expected: "plain/prefix",
+		},
+		{
+			template: "{{ build.tag }}/{{ file.ext }}",
+			values:   build,
+			expected: "v1.2.0/{{ file.ext }}",
+		},
+		{
+			template: "{{ file.ext }}/{{ file.dir }}/{{ file.base }}",
+			values:   fileValues("dist/js/app.min.js"),
+			expected: "js/js/app.min",
+		},
+	}
+
+	for _, tc := range tests {
+		if got := expandTemplate(tc.template, tc.values); got != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.template, tc.expected, got)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		template    string
+		perFile     bool
+		expectError bool
+	}{
+		{template: "releases/{{ build.tag }}", perFile: false},
+		{template: "{{ file.name }}", perFile: true},
+		{template: "{{ file.name }}", perFile: false, expectError: true},
+		{template: "{{ build.nope }}", perFile: true, expectError: true},
+		{template: "no/placeholders", perFile: false},
+	}
+
+	for _, tc := range tests {
+		err := validateTemplate(tc.template, tc.perFile)
+		if tc.expectError && err == nil {
+			t.Errorf("%q: expected error", tc.template)
+		} else if !tc.expectError && err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.template, err)
+		}
+	}
+}
+
+func TestTemplatePrefix(t *testing.T) {
+	if got := templatePrefix("site/{{ build.tag }}/x"); got != "site/" {
+		t.Errorf("expected %q, got %q", "site/", got)
+	}
+	if got := templatePrefix("site/x"); got != "site/x" {
+		t.Errorf("expected %q, got %q", "site/x", got)
+	}
+}
+
+func TestObjectKeyFilePlaceholders(t *testing.T) {
+	tests := []struct {
+		target      string
+		stripPrefix string
+		expected    string
+	}{
+		{target: "assets/{{ file.ext }}/{{ file.name }}", expected: "assets/js/app.js"},
+		{target: "assets/{{ file.name }}", stripPrefix: "dist/", expected: "assets/app.js"},
+		{target: "assets/{{ file.base }}-v2.{{ file.ext }}", stripPrefix: "dist/", expected: "assets/app-v2.js"},
+		{target: "/{{ file.dir }}/{{ file.name }}", expected: "js/app.js"},
+		// placeholders not naming the file select a prefix
+		{target: "assets/{{ file.ext }}", stripPrefix: "dist/", expected: "assets/js/js/app.js"},
+		{target: "assets", stripPrefix: "dist/", expected: "assets/js/app.js"},
+	}
+
+	for _, tc := range tests {
+		p := &Plugin{Target: tc.target, StripPrefix: tc.stripPrefix}
+		got, _, _ := p.objectKey("dist/js/app.js", tc.stripPrefix, nil)
+		if got != tc.expected {
+			t.Errorf("%s (strip '%s'): expected '%s', got '%s'", tc.target, tc.stripPrefix, tc.expected, got)
+		}
+	}
+}
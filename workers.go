@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// forEachParallel calls fn for every item using at most workers goroutines.
+// The first failure cancels the context handed to fn and stops dispatching
+// further items; every error returned by fn is joined into the result.
+func forEachParallel[T any](ctx context.Context, workers int, items []T, fn func(context.Context, T) error) error {
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	return streamParallel(ctx, workers, func(_ context.Context, send func(T) bool) error {
+		for _, item := range items {
+			if !send(item) {
+				break
+			}
+		}
+		return nil
+	}, fn)
+}
+
+// streamParallel calls fn for every item produce sends, using at most workers
+// goroutines. send reports false once processing was cancelled, after which
+// produce should return. Failures of produce and fn are handled as in
+// forEachParallel.
+func streamParallel[T any](ctx context.Context, workers int, produce func(context.Context, func(T) bool) error, fn func(context.Context, T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		// items aborted by an earlier failure only add noise
+		if len(errs) == 0 || !errors.Is(err, context.Canceled) {
+			errs = append(errs, err)
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	queue := make(chan T)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				if err := fn(ctx, item); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err := produce(ctx, func(item T) bool {
+		select {
+		case queue <- item:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	close(queue)
+	wg.Wait()
+
+	if err != nil {
+		fail(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) == 0 {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
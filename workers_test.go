@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachParallel(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+
+	var (
+		sum     int64
+		running int64
+		peak    int64
+	)
+	err := forEachParallel(context.Background(), 4, items, func(_ context.Context, i int) error {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		atomic.AddInt64(&sum, int64(i))
+		atomic.AddInt64(&running, -1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sum != 4950 {
+		t.Errorf("expected every item to be processed, sum = %d", sum)
+	}
+	if peak > 4 {
+		t.Errorf("expected at most 4 concurrent workers, got %d", peak)
+	}
+}
+
+func TestForEachParallelStopsOnError(t *testing.T) {
+	items := make([]int, 1000)
+	errBoom := errors.New("boom")
+
+	var calls int64
+	err := forEachParallel(context.Background(), 1, items, func(ctx context.Context, _ int) error {
+		if atomic.AddInt64(&calls, 1) == 3 {
+			return errBoom
+		}
+		return ctx.Err()
+	})
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("expected boom error, got %v", err)
+	}
+	if calls > 4 {
+		t.Errorf("expected dispatch to stop after the failure, got %d calls", calls)
+	}
+}
+
+func TestForEachParallelEmpty(t *testing.T) {
+	err := forEachParallel(context.Background(), 8, []string{}, func(context.Context, string) error {
+		t.Fatal("fn must not be called")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamParallelProducerError(t *testing.T) {
+	errList := errors.New("list failed")
+
+	var calls int64
+	err := streamParallel(context.Background(), 3, func(_ context.Context, send func(int) bool) error {
+		for i := 0; i < 5; i++ {
+			if !send(i) {
+				return nil
+			}
+		}
+		return errList
+	}, func(context.Context, int) error {
+		atomic.AddInt64(&calls, 1)
+		return nil
+	})
+	if !errors.Is(err, errList) {
+		t.Fatalf("expected list error, got %v", err)
+	}
+	if calls != 5 {
+		t.Errorf("expected 5 calls before the producer failed, got %d", calls)
+	}
+}